@@ -1,60 +1,99 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
-const IssuesURL = "https://api.github.com/search/issues"
+const (
+	APIURL    = "https://api.github.com"
+	IssuesURL = APIURL + "/search/issues"
+)
+
+// TokenEnv names the environment variable holding the access token,
+// and APIEnv the one naming another API root, as for GitHub Enterprise.
+const (
+	TokenEnv = "GITHUB_TOKEN"
+	APIEnv   = "GITHUB_API_URL"
+)
 
+// The report templates, selected by -format, are executed with an
+// ageReport.
 const templ = `{{.TotalCount}} issues:
+{{range .Buckets}}{{if .Items}}
+{{.Name}}:
 {{range .Items}}----------------------------------------
 Number: {{.Number}}
 User:   {{.User.Login}}
-Title:  {{.Title | printf "%.64s"}}
+Title:  {{.Title | truncate 64}}
 Age:    {{.CreatedAt | daysAgo}} days
-{{end}}`
+{{with .Labels}}Labels: {{labels .}}
+{{end}}{{with .Assignees}}Assignees: {{assignees .}}
+{{end}}{{end}}{{end}}{{end}}`
+
+const markdownTempl = `# {{.TotalCount}} issues
+{{range .Buckets}}{{if .Items}}
+## {{.Name}}
+
+| # | Title | User | Labels | Assignees | Age (days) |
+|--:|-------|------|--------|-----------|-----------:|
+{{range .Items}}| [{{.Number}}]({{.HTMLURL}}) | {{.Title | truncate 64 | mdcell}} | {{.User.Login}} | {{labels .Labels | mdcell}} | {{assignees .Assignees}} | {{.CreatedAt | daysAgo}} |
+{{end}}{{end}}{{end}}`
+
+const csvTempl = `age,number,state,user,title,labels,assignees,created_at,url
+{{range .Buckets}}{{$age := .Name}}{{range .Items -}}
+{{csv $age}},{{.Number}},{{.State}},{{csv .User.Login}},{{csv .Title}},{{labels .Labels | csv}},{{assignees .Assignees | csv}},{{.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}},{{csv .HTMLURL}}
+{{end}}{{end}}`
 
 type IssuesSearchResult struct {
 	TotalCount int `json:"total_count"`
 	Items      []*Issue
 }
 
-var issueList = template.Must(template.New("issuelist").Parse(`
-<h1>{{.Total}} issues</h1>
-<table>
-<tr style='text-align: left'>
-	<th>#</th>
-	<th>State</th>
-	<th>User</th>
-	<th>Title</th>
-</tr>
-{{range .Items}}
-<tr>
-	<td><a href='{{.HTMLURL}}'>{{.Number}}</th>
-	<td>{{.State}}</td>
-	<td><a href='{{.User.HTMLURL}}'>{{.User.Login}}</a></td>
-	<td><a href='{{.HTMLURL}}'>{{.Title}}</a></td>
-</tr>
-{{end}}
-</table>
-`))
-
 type Issue struct {
-	Number    int
-	HTMLURL   string `json:"html_url"`
-	Title     string
-	State     string
-	User      *User
-	CreatedAt time.Time `json:"created_at"`
-	Body      string    // in markdown
+	Number        int
+	HTMLURL       string `json:"html_url"`
+	RepositoryURL string `json:"repository_url"`
+	Title         string
+	State         string
+	User          *User
+	Assignees     []*User
+	Labels        []*Label
+	Milestone     *Milestone
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Body          string    // in markdown
+
+	// PullRequest is set if the "issue" is a pull request,
+	// as some of those the issues API lists are.
+	PullRequest *struct{} `json:"pull_request,omitempty"`
+}
+
+// Repo returns the owner/name of the repository the issue belongs to.
+func (i *Issue) Repo() string {
+	// RepositoryURL is like https://api.github.com/repos/owner/name.
+	dir, name := path.Split(i.RepositoryURL)
+	return path.Base(dir) + "/" + name
 }
 
 type User struct {
@@ -62,53 +101,1252 @@ type User struct {
 	HTMLURL string `json:"html_url"`
 }
 
+type Label struct {
+	Name string
+}
+
+type Milestone struct {
+	Number  int
+	Title   string
+	State   string
+	HTMLURL string `json:"html_url"`
+}
+
+// An IssueEdit is the body of a request to create or edit an issue.
+// Only the fields that are not nil are changed.
+type IssueEdit struct {
+	Title  *string   `json:"title,omitempty"`
+	Body   *string   `json:"body,omitempty"`
+	State  *string   `json:"state,omitempty"` // "open" or "closed"
+	Labels *[]string `json:"labels,omitempty"`
+}
+
 func daysAgo(t time.Time) int {
 	return int(time.Since(t).Hours() / 24)
 }
 
-func SearchIssues(terms []string) (*IssuesSearchResult, error) {
+// An ageReport is a search result with its issues grouped by age.
+type ageReport struct {
+	*IssuesSearchResult
+	Buckets []ageBucket
+}
+
+type ageBucket struct {
+	Name  string
+	Items []*Issue
+}
+
+// byAge groups the issues of result into those less than a month
+// old, those less than a year old, and the rest, keeping their order.
+func byAge(result *IssuesSearchResult) *ageReport {
+	now := time.Now()
+	monthAgo, yearAgo := now.AddDate(0, -1, 0), now.AddDate(-1, 0, 0)
+	r := &ageReport{result, []ageBucket{
+		{Name: "less than a month old"},
+		{Name: "less than a year old"},
+		{Name: "more than a year old"},
+	}}
+	for _, item := range result.Items {
+		switch {
+		case item.CreatedAt.After(monthAgo):
+			r.Buckets[0].Items = append(r.Buckets[0].Items, item)
+		case item.CreatedAt.After(yearAgo):
+			r.Buckets[1].Items = append(r.Buckets[1].Items, item)
+		default:
+			r.Buckets[2].Items = append(r.Buckets[2].Items, item)
+		}
+	}
+	return r
+}
+
+// labels returns the names of labels, separated by commas.
+func labels(labels []*Label) string {
+	var names []string
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// assignees returns the logins of users, separated by commas.
+func assignees(users []*User) string {
+	var logins []string
+	for _, u := range users {
+		logins = append(logins, u.Login)
+	}
+	return strings.Join(logins, ", ")
+}
+
+// truncate shortens s to at most n characters, marking any cut with
+// an ellipsis. It takes s last so as to end a pipeline.
+func truncate(n int, s string) string {
+	if r := []rune(s); len(r) > n && n > 0 {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// mdcell makes s safe to put in a cell of a markdown table.
+func mdcell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// csvField quotes s as a CSV field, if need be.
+func csvField(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+var funcs = template.FuncMap{
+	"daysAgo":   daysAgo,
+	"labels":    labels,
+	"assignees": assignees,
+	"truncate":  truncate,
+	"mdcell":    mdcell,
+	"csv":       csvField,
+}
+
+// A Client makes requests of the GitHub API. Its zero value searches
+// IssuesURL through http.DefaultClient, unauthenticated, and gives up
+// at once when rate-limited.
+type Client struct {
+	APIURL     string        // API root, if not APIURL
+	IssuesURL  string        // search endpoint, if not the one under APIURL
+	HTTPClient *http.Client  // if nil, http.DefaultClient
+	Token      string        // personal access token, if any
+	MaxWait    time.Duration // longest to wait for a rate limit to reset
+}
+
+// DefaultClient is the Client used by SearchIssues.
+var DefaultClient = &Client{
+	APIURL:  os.Getenv(APIEnv),
+	Token:   os.Getenv(TokenEnv),
+	MaxWait: time.Minute,
+}
+
+// SearchIssues queries the GitHub issue tracker using DefaultClient.
+func SearchIssues(terms []string, limit int) (*IssuesSearchResult, error) {
+	return DefaultClient.SearchIssues(terms, limit)
+}
+
+// SearchIssues queries the GitHub issue tracker, following the pages
+// of results until it has limit issues, or all of them if limit <= 0.
+func (c *Client) SearchIssues(terms []string, limit int) (*IssuesSearchResult, error) {
+	base := c.IssuesURL
+	if base == "" && c.APIURL != "" {
+		base = c.APIURL + "/search/issues"
+	} else if base == "" {
+		base = IssuesURL
+	}
+	perPage := 100 // the most GitHub allows
+	if limit > 0 && limit < perPage {
+		perPage = limit
+	}
 	q := url.QueryEscape(strings.Join(terms, " "))
-	resp, err := http.Get(IssuesURL + "?q=" + q)
-	if err != nil {
+	next := fmt.Sprintf("%s?q=%s&per_page=%d", base, q, perPage)
+
+	var result IssuesSearchResult
+	for next != "" && (limit <= 0 || len(result.Items) < limit) {
+		resp, err := c.send("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("search query failed: %s", resp.Status)
+		}
+
+		var page IssuesSearchResult
+		// streaming decoder
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		result.TotalCount = page.TotalCount
+		result.Items = append(result.Items, page.Items...)
+		next = nextPage(resp.Header.Get("Link"))
+	}
+	if limit > 0 && len(result.Items) > limit {
+		result.Items = result.Items[:limit]
+	}
+	return &result, nil
+}
+
+// GetIssue returns issue number of the repository owner/repo.
+func (c *Client) GetIssue(owner, repo string, number int) (*Issue, error) {
+	var issue Issue
+	path := fmt.Sprintf("/repos/%s/%s/issues/%d", owner, repo, number)
+	if err := c.call("GET", path, nil, &issue); err != nil {
+		return nil, err
+	}
+	return &issue, nil
+}
+
+// CreateIssue opens a new issue in the repository owner/repo.
+func (c *Client) CreateIssue(owner, repo string, edit *IssueEdit) (*Issue, error) {
+	var issue Issue
+	path := fmt.Sprintf("/repos/%s/%s/issues", owner, repo)
+	if err := c.call("POST", path, edit, &issue); err != nil {
 		return nil, err
 	}
+	return &issue, nil
+}
+
+// EditIssue changes issue number of the repository owner/repo,
+// which is how issues are closed and reopened too.
+func (c *Client) EditIssue(owner, repo string, number int, edit *IssueEdit) (*Issue, error) {
+	var issue Issue
+	path := fmt.Sprintf("/repos/%s/%s/issues/%d", owner, repo, number)
+	if err := c.call("PATCH", path, edit, &issue); err != nil {
+		return nil, err
+	}
+	return &issue, nil
+}
+
+// RenderMarkdown returns the HTML for text, GitHub-flavored markdown
+// in which issue references are relative to the repository owner/name.
+func (c *Client) RenderMarkdown(text, repo string) (string, error) {
+	base := c.APIURL
+	if base == "" {
+		base = APIURL
+	}
+	body, err := json.Marshal(map[string]string{"text": text, "mode": "gfm", "context": repo})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.send("POST", base+"/markdown", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("search query failed: %s", resp.Status)
+		return "", fmt.Errorf("rendering markdown: %s", resp.Status)
 	}
+	html, err := ioutil.ReadAll(resp.Body)
+	return string(html), err
+}
 
-	var result IssuesSearchResult
-	// streaming decoder
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+// call sends in, if not nil, as JSON in a request to path under
+// c.APIURL and decodes the response into out.
+func (c *Client) call(method, path string, in, out interface{}) error {
+	base := c.APIURL
+	if base == "" {
+		base = APIURL
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := c.send(method, base+path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// GitHub explains what went wrong in the body.
+		var e struct{ Message string }
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes a request of url with c's credentials. If the rate limit
+// has been exceeded, it waits for it to reset and tries again, provided
+// that takes no longer than c.MaxWait.
+func (c *Client) send(method, url string, body []byte) (*http.Response, error) {
+	const maxTries = 3
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for tries := 1; ; tries++ {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "token "+c.Token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := rateLimited(resp)
+		if !limited {
+			return resp, nil
+		}
 		resp.Body.Close()
-		return nil, err
+		if wait > c.MaxWait || tries == maxTries {
+			return nil, fmt.Errorf("rate limit exceeded; resets in %s", wait.Round(time.Second))
+		}
+		log.Printf("rate limit exceeded; retrying in %s", wait.Round(time.Second))
+		time.Sleep(wait)
 	}
-	resp.Body.Close()
-	return &result, nil
 }
 
-var report = template.Must(template.New("report").Funcs(template.FuncMap{"daysAgo": daysAgo}).Parse(templ))
+// rateLimited reports whether resp is a refusal because the rate
+// limit was exceeded, and if so how long until it resets.
+func rateLimited(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	// Secondary rate limits say how long to wait directly.
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false // forbidden for some other reason
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	wait := time.Until(time.Unix(reset, 0)) + time.Second // allow for clock skew
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// nextPage returns the URL of the next page from a Link header like
+//
+//	<https://api.github.com/search/issues?q=go&page=2>; rel="next", <...>; rel="last"
+//
+// or "" if this is the last page.
+func nextPage(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+const issueTempl = `#{{.Number}} {{.Title}}
+{{.State}} · opened by {{.User.Login}} {{.CreatedAt | daysAgo}} days ago
+{{- with .Labels}} · labels: {{labels .}}{{end}}
+{{- with .Assignees}} · assigned to {{assignees .}}{{end}}
+{{.HTMLURL}}
+{{if .Body}}
+{{.Body}}
+{{end}}`
+
+var showIssue = template.Must(template.New("issue").Funcs(funcs).Parse(issueTempl))
+
+// reports are the templates for the search results, by -format.
+var reports = map[string]*template.Template{
+	"text":     template.Must(template.New("report").Funcs(funcs).Parse(templ)),
+	"markdown": template.Must(template.New("markdown").Funcs(funcs).Parse(markdownTempl)),
+	"csv":      template.Must(template.New("csv").Funcs(funcs).Parse(csvTempl)),
+}
+
+var (
+	limit    = flag.Int("limit", 30, "fetch at most `n` issues (0 for all)")
+	maxWait  = flag.Duration("wait", time.Minute, "wait at most `d` for the rate limit to reset")
+	format   = flag.String("format", "text", "print search results as `text`, markdown or csv")
+	httpAddr = flag.String("http", "", "serve a web UI for searching issues on `addr` instead of printing a report")
+	cacheTTL = flag.Duration("cache", 5*time.Minute, "reuse results in the web UI for `d`")
+	repo     = flag.String("repo", "", "the repository, as `owner/name`, whose issues to create, show, edit or sync")
+	offline  = flag.Bool("offline", false, "search and show the issues of -repo in its mirror, as of the last sync")
+	mirrors  = flag.String("mirrors", defaultMirrors(), "keep mirrors of repositories' issues in `dir`")
+)
+
+// An issueSource is where issues are searched for and shown from:
+// GitHub itself, or a Mirror of one repository with -offline.
+type issueSource interface {
+	SearchIssues(terms []string, limit int) (*IssuesSearchResult, error)
+	GetIssue(owner, repo string, number int) (*Issue, error)
+}
+
+var source issueSource = DefaultClient
+
+// commands are the subcommands that act on a single issue of -repo.
+var commands = map[string]func(owner, repo string, args []string) error{
+	"create": create,
+	"show":   show,
+	"edit":   edit,
+	"close":  setState("closed"),
+	"reopen": setState("open"),
+	"sync":   syncMirror,
+}
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `usage: github [flags] search terms...
+       github [flags] -http addr [default search terms...]
+       github [flags] -repo owner/name create [-title t] [-body b] [-labels l,...]
+       github [flags] -repo owner/name show|close|reopen number
+       github [flags] -repo owner/name edit [-title t] [-body b] [-labels l,...] number
+       github [flags] -repo owner/name sync
+Without -body, create and edit open $EDITOR on the title and body.
+Sync updates the mirror of the repository's issues that searches,
+show and the web UI use with -offline.
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	DefaultClient.MaxWait = *maxWait
+	report := reports[*format]
+	if report == nil {
+		log.Fatalf("github: unknown -format %q", *format)
+	}
+
+	var mirror *Mirror
+	if *offline {
+		owner, name := repoFlag("-offline")
+		var err error
+		if mirror, err = OpenMirror(*mirrors, owner, name); err != nil {
+			log.Fatal(err)
+		}
+		if mirror.Synced.IsZero() {
+			log.Fatalf("github: %s/%s has not been synced", owner, name)
+		}
+		source = mirror
+	}
+
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "search" {
+		args = args[1:]
+	} else if len(args) > 0 && commands[args[0]] != nil {
+		owner, name := repoFlag(args[0])
+		if err := commands[args[0]](owner, name, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *httpAddr != "" {
+		log.Fatal(serve(*httpAddr, strings.Join(args, " "), mirror))
+	}
 
-	result, err := SearchIssues(os.Args[1:])
+	result, err := source.SearchIssues(args, *limit)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("%d issues:\n", result.TotalCount)
 	// for _, item := range result.Items {
 	// 	fmt.Printf("#%-5d %9.9s %.55s\n", item.Number, item.User.Login, item.Title)
 	// }
 
 	// Once the template has been created, augmented with daysAgo, parsed, and checked
 	// we can execute it using a github IssueSearchResult as the data source
-	if err := report.Execute(os.Stdout, result); err != nil {
+	if err := report.Execute(os.Stdout, byAge(result)); err != nil {
 		log.Fatal(err)
 	}
+	if mirror != nil {
+		// On stderr, so as not to spoil CSV.
+		fmt.Fprintf(os.Stderr, "\n%s\n", mirror.Summary())
+		printChanges(os.Stderr, mirror.Changes)
+	}
+}
 
-	http.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
-		issueList.Execute(rw, result)
+// repoFlag returns the owner and name from -repo, which cmd needs.
+func repoFlag(cmd string) (owner, name string) {
+	parts := strings.Split(*repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		log.Fatalf("github: %s needs -repo owner/name", cmd)
+	}
+	return parts[0], parts[1]
+}
+
+// editFlags returns a FlagSet for the fields of an issue, and the
+// IssueEdit it fills in with those that are given.
+func editFlags(name string) (*flag.FlagSet, *IssueEdit) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	edit := new(IssueEdit)
+	fs.Func("title", "set the title to `t`", func(s string) error {
+		edit.Title = &s
+		return nil
+	})
+	fs.Func("body", "set the body to `b`, in markdown", func(s string) error {
+		edit.Body = &s
+		return nil
 	})
+	fs.Func("labels", "set the labels to the comma-separated `list`", func(s string) error {
+		labels := []string{} // so that "" clears them
+		for _, l := range strings.Split(s, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				labels = append(labels, l)
+			}
+		}
+		edit.Labels = &labels
+		return nil
+	})
+	return fs, edit
+}
+
+func create(owner, repo string, args []string) error {
+	fs, edit := editFlags("create")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("create: unexpected arguments %q", fs.Args())
+	}
+	if edit.Body == nil {
+		title, body, err := editText(deref(edit.Title), "")
+		if err != nil {
+			return err
+		}
+		edit.Title, edit.Body = &title, &body
+	}
+	if deref(edit.Title) == "" {
+		return fmt.Errorf("create: an issue needs a title")
+	}
+	issue, err := DefaultClient.CreateIssue(owner, repo, edit)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created #%d %s\n", issue.Number, issue.HTMLURL)
+	return nil
+}
+
+func show(owner, repo string, args []string) error {
+	number, err := issueNumber("show", args)
+	if err != nil {
+		return err
+	}
+	issue, err := source.GetIssue(owner, repo, number)
+	if err != nil {
+		return err
+	}
+	return showIssue.Execute(os.Stdout, issue)
+}
+
+func edit(owner, repo string, args []string) error {
+	fs, edit := editFlags("edit")
+	fs.Parse(args)
+	number, err := issueNumber("edit", fs.Args())
+	if err != nil {
+		return err
+	}
+	if *edit == (IssueEdit{}) {
+		// Nothing given on the command line: edit the text.
+		issue, err := DefaultClient.GetIssue(owner, repo, number)
+		if err != nil {
+			return err
+		}
+		title, body, err := editText(issue.Title, issue.Body)
+		if err != nil {
+			return err
+		}
+		if title == issue.Title && body == strings.TrimSpace(issue.Body) {
+			fmt.Println("no changes")
+			return nil
+		}
+		edit.Title, edit.Body = &title, &body
+	}
+	issue, err := DefaultClient.EditIssue(owner, repo, number, edit)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("edited #%d %s\n", issue.Number, issue.HTMLURL)
+	return nil
+}
+
+// setState returns a command that closes or reopens an issue.
+func setState(state string) func(owner, repo string, args []string) error {
+	return func(owner, repo string, args []string) error {
+		number, err := issueNumber(state, args)
+		if err != nil {
+			return err
+		}
+		issue, err := DefaultClient.EditIssue(owner, repo, number, &IssueEdit{State: &state})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("#%d is %s\n", issue.Number, issue.State)
+		return nil
+	}
+}
+
+func issueNumber(cmd string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("%s: want one issue number", cmd)
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: bad issue number %q", cmd, args[0])
+	}
+	return n, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// editText lets the user edit a title and body in $EDITOR, as the
+// first line of a file and the rest. It returns them trimmed of
+// surrounding space.
+func editText(title, body string) (string, string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "issue-*.md")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "%s\n\n%s", title, body)
+	if err := f.Close(); err != nil {
+		return "", "", err
+	}
+
+	// $EDITOR may have arguments, as in "code --wait".
+	argv := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("%s: %v", editor, err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", "", err
+	}
+	title, body = string(data), ""
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title, body = title[:i], title[i+1:]
+	}
+	title, body = strings.TrimSpace(title), strings.TrimSpace(body)
+	if title == "" && body == "" {
+		return "", "", fmt.Errorf("aborting: the issue is empty")
+	}
+	return title, body, nil
+}
+
+func syncMirror(owner, repo string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("sync: unexpected arguments %q", args)
+	}
+	m, err := OpenMirror(*mirrors, owner, repo)
+	if err != nil {
+		return err
+	}
+	if err := DefaultClient.Sync(m); err != nil {
+		return err
+	}
+	if err := m.Save(); err != nil {
+		return err
+	}
+	fmt.Println(m.Summary())
+	printChanges(os.Stdout, m.Changes)
+	return nil
+}
+
+func printChanges(w io.Writer, changes []Change) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "  #%-5d %-8s %s\n", c.Number, c.Kind, truncate(60, c.Title))
+	}
+}
+
+// defaultMirrors returns the directory for mirrors if -mirrors isn't given.
+func defaultMirrors() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "github-mirrors"
+	}
+	return filepath.Join(dir, "github-issues")
+}
+
+// A Mirror is a local copy of the issues of one repository, kept
+// as JSON in a file of its own. Sync brings it up to date by fetching
+// only the issues updated since the last time.
+type Mirror struct {
+	Repo    string         `json:"repo"`    // owner/name
+	Synced  time.Time      `json:"synced"`  // when the last sync was made
+	Since   time.Time      `json:"since"`   // the latest updated_at seen, where the next sync starts
+	Issues  map[int]*Issue `json:"issues"`  // by number
+	Changes []Change       `json:"changes"` // made by the last sync
+
+	path string
+}
+
+// A Change is a difference an issue made to a Mirror in a sync.
+type Change struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Kind   string `json:"kind"` // "new", "updated", "closed" or "reopened"
+}
+
+// OpenMirror loads the mirror of owner/repo kept in dir, or returns
+// an empty one, yet to be synced, if there is none.
+func OpenMirror(dir, owner, repo string) (*Mirror, error) {
+	m := &Mirror{
+		Repo:   owner + "/" + repo,
+		Issues: make(map[int]*Issue),
+		path:   filepath.Join(dir, owner, repo+".json"),
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", m.path, err)
+	}
+	return m, nil
+}
+
+// Save writes m back to its file.
+func (m *Mirror) Save() error {
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// Summary says how up to date m is and what its last sync changed.
+func (m *Mirror) Summary() string {
+	return fmt.Sprintf("%s: %d issues, synced %s ago; %d changed in that sync",
+		m.Repo, len(m.Issues), time.Since(m.Synced).Round(time.Second), len(m.Changes))
+}
+
+// Sync fetches the issues of m's repository updated since the last
+// sync, or all of them the first time, and records what changed.
+func (c *Client) Sync(m *Mirror) error {
+	base := c.APIURL
+	if base == "" {
+		base = APIURL
+	}
+	started := time.Now()
+	next := fmt.Sprintf("%s/repos/%s/issues?state=all&sort=updated&direction=asc&per_page=100", base, m.Repo)
+	if !m.Since.IsZero() {
+		// since is inclusive, so the latest issue comes again;
+		// it's not a change unless it has been updated since.
+		next += "&since=" + m.Since.UTC().Format(time.RFC3339)
+	}
+
+	var changes []Change
+	for next != "" {
+		resp, err := c.send("GET", next, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("syncing %s: %s", m.Repo, resp.Status)
+		}
+		var page []*Issue
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		resp.Body.Close()
+		for _, issue := range page {
+			if issue.UpdatedAt.After(m.Since) {
+				m.Since = issue.UpdatedAt
+			}
+			if issue.PullRequest != nil {
+				continue
+			}
+			old := m.Issues[issue.Number]
+			change := Change{Number: issue.Number, Title: issue.Title}
+			switch {
+			case old == nil:
+				change.Kind = "new"
+			case old.State != issue.State && issue.State == "closed":
+				change.Kind = "closed"
+			case old.State != issue.State:
+				change.Kind = "reopened"
+			case !old.UpdatedAt.Equal(issue.UpdatedAt):
+				change.Kind = "updated"
+			default:
+				continue // seen last time
+			}
+			m.Issues[issue.Number] = issue
+			changes = append(changes, change)
+		}
+		next = nextPage(resp.Header.Get("Link"))
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Number < changes[j].Number })
+	m.Changes = changes
+	m.Synced = started
+	return nil
+}
+
+// SearchIssues searches m for the issues matching all the terms, most
+// recently updated first. Besides words to look for in the title and
+// body, it understands the qualifiers is:open, is:closed, label:name,
+// author:login, assignee:login and milestone:title; it ignores others.
+func (m *Mirror) SearchIssues(terms []string, limit int) (*IssuesSearchResult, error) {
+	result := new(IssuesSearchResult)
+	for _, issue := range m.Issues {
+		if matches(issue, terms) {
+			result.Items = append(result.Items, issue)
+		}
+	}
+	sort.Slice(result.Items, func(i, j int) bool {
+		return result.Items[i].UpdatedAt.After(result.Items[j].UpdatedAt)
+	})
+	result.TotalCount = len(result.Items)
+	if limit > 0 && len(result.Items) > limit {
+		result.Items = result.Items[:limit]
+	}
+	return result, nil
+}
+
+func matches(issue *Issue, terms []string) bool {
+	text := strings.ToLower(issue.Title + "\n" + issue.Body)
+	for _, term := range terms {
+		term = strings.ToLower(term)
+		i := strings.Index(term, ":")
+		if i < 0 {
+			if !strings.Contains(text, term) {
+				return false
+			}
+			continue
+		}
+		key, value := term[:i], term[i+1:]
+		ok := true
+		switch key {
+		case "is", "state":
+			ok = value != "open" && value != "closed" || value == issue.State
+		case "label":
+			ok = strings.Contains(strings.ToLower(labels(issue.Labels)+", "), value+", ")
+		case "author":
+			ok = issue.User != nil && strings.ToLower(issue.User.Login) == value
+		case "assignee":
+			ok = strings.Contains(strings.ToLower(assignees(issue.Assignees)+", "), value+", ")
+		case "milestone":
+			ok = issue.Milestone != nil && strings.ToLower(issue.Milestone.Title) == strings.Trim(value, `"`)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// GetIssue returns issue number of m, which must be of owner/repo.
+func (m *Mirror) GetIssue(owner, repo string, number int) (*Issue, error) {
+	issue := m.Issues[number]
+	if owner+"/"+repo != m.Repo || issue == nil {
+		return nil, fmt.Errorf("%s/%s#%d is not in the mirror of %s", owner, repo, number, m.Repo)
+	}
+	return issue, nil
+}
+
+// The web UI. Every page takes the search query as its q parameter;
+// the results are cached for -cache so that sorting and moving
+// between pages don't repeat it.
+
+var pages = htmltemplate.Must(htmltemplate.New("pages").Funcs(htmltemplate.FuncMap{
+	"daysAgo":   daysAgo,
+	"labels":    labels,
+	"assignees": assignees,
+	"issuePath": issuePath,
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title>
+<style>
+body { font-family: sans-serif; }
+th, td { padding: 0 .5em; text-align: left; }
+</style></head><body>
+{{end}}
+
+{{define "nav"}}
+<form action="/"><input name="q" size="60" value="{{.}}"> <input type="submit" value="Search"></form>
+<p><a href="/?q={{.}}">Issues</a> · <a href="/milestones?q={{.}}">Milestones</a> · <a href="/users?q={{.}}">Users</a></p>
+{{end}}
+
+{{define "issueList"}}{{template "header" .Query}}{{template "nav" .Query}}
+{{with .Mirror}}<p><em>Offline: {{.Summary}}.</em></p>
+{{if .Changes}}<ul>
+{{range .Changes}}<li><a href="/issue/{{$.Mirror.Repo}}/{{.Number}}?q={{$.Query}}">#{{.Number}}</a> {{.Kind}}: {{.Title}}</li>
+{{end}}</ul>{{end}}{{end}}
+<h1>{{.Result.TotalCount}} issues</h1>
+<table>
+<tr>
+	{{range .Columns}}<th><a href="{{.URL}}">{{.Name}}</a>{{.Arrow}}</th>
+	{{end}}<th>Milestone</th>
+	<th>Title</th>
+</tr>
+{{range .Items}}
+<tr>
+	<td><a href="{{issuePath .}}?q={{$.Query}}">{{.Number}}</a></td>
+	<td>{{.State}}</td>
+	<td><a href="/users?q={{$.Query}}#{{.User.Login}}">{{.User.Login}}</a></td>
+	<td>{{.CreatedAt | daysAgo}} days</td>
+	<td>{{with .Milestone}}<a href="/milestones?q={{$.Query}}#m{{.Number}}">{{.Title}}</a>{{end}}</td>
+	<td><a href="{{issuePath .}}?q={{$.Query}}">{{.Title}}</a></td>
+</tr>
+{{end}}
+</table>
+</body></html>
+{{end}}
+
+{{define "issue"}}{{template "header" .Issue.Title}}{{template "nav" .Query}}
+{{with .Issue}}
+<h1>{{.Title}} <a href="{{.HTMLURL}}">{{.Repo}}#{{.Number}}</a></h1>
+<p>{{.State}} · opened by <a href="{{.User.HTMLURL}}">{{.User.Login}}</a>
+(<a href="/users?q={{$.Query}}#{{.User.Login}}">issues</a>)
+{{.CreatedAt | daysAgo}} days ago
+{{with .Milestone}} · milestone <a href="{{.HTMLURL}}">{{.Title}}</a>{{end}}
+{{with .Labels}} · labels: {{labels .}}{{end}}
+{{with .Assignees}} · assigned to {{range $i, $u := .}}{{if $i}}, {{end}}<a href="{{$u.HTMLURL}}">{{$u.Login}}</a>{{end}}{{end}}
+</p>
+{{end}}
+<hr>
+{{.Body}}
+</body></html>
+{{end}}
+
+{{define "groups"}}{{template "header" .Title}}{{template "nav" .Query}}
+<h1>{{.Title}}</h1>
+{{range .Groups}}
+<h2 id="{{.ID}}">{{if .URL}}<a href="{{.URL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}} ({{len .Items}})</h2>
+<ul>
+{{range .Items}}<li><a href="{{issuePath .}}?q={{$.Query}}">{{.Repo}}#{{.Number}}</a> {{.Title}} ({{.State}})</li>
+{{end}}</ul>
+{{end}}
+</body></html>
+{{end}}
+`))
+
+// issuePath returns the path of the web UI's page for issue.
+func issuePath(issue *Issue) string {
+	return fmt.Sprintf("/issue/%s/%d", issue.Repo(), issue.Number)
+}
+
+// A webCache remembers what the web UI has fetched, for a while.
+// Like a Memo, it fetches each key once however many requests want
+// it at the same time: the first fetches, and the others wait.
+// It holds at most maxWebCacheEntries, so that requests for ever
+// different pages can't make it grow without limit.
+type webCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex // guards entries and the fields set by fetching them
+	entries map[string]*webCacheEntry
+}
+
+type webCacheEntry struct {
+	ready   chan struct{} // closed when value and err are set
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// stale reports whether e has been fetched and has since expired.
+// The caller must hold c.mu.
+func (e *webCacheEntry) stale(now time.Time) bool {
+	select {
+	case <-e.ready:
+		return now.After(e.expires)
+	default:
+		return false // being fetched
+	}
+}
+
+// get returns the value cached under key, calling fetch for it if
+// there is none or it has expired. Failures aren't cached.
+func (c *webCache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	e := c.entries[key]
+	if e == nil || e.stale(time.Now()) {
+		// This is the first request for key since it was last
+		// fetched, so this goroutine fetches it.
+		if e == nil && len(c.entries) >= maxWebCacheEntries {
+			c.evict()
+		}
+		e = &webCacheEntry{ready: make(chan struct{})}
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		v, err := fetch()
+
+		c.mu.Lock()
+		e.value, e.err, e.expires = v, err, time.Now().Add(c.ttl)
+		if err != nil && c.entries[key] == e {
+			delete(c.entries, key) // those waiting still get err
+		}
+		close(e.ready) // broadcast the ready condition
+		c.mu.Unlock()
+	} else {
+		c.mu.Unlock()
+		<-e.ready // wait for ready condition
+	}
+	return e.value, e.err
+}
+
+const maxWebCacheEntries = 1000
+
+// evict removes the expired entries, or if there are none the one
+// that expires first, which is the oldest. Entries being fetched are
+// kept for those waiting on them. The caller must hold c.mu.
+func (c *webCache) evict() {
+	now := time.Now()
+	var oldest string
+	for key, e := range c.entries {
+		select {
+		case <-e.ready:
+		default:
+			continue
+		}
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= maxWebCacheEntries && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// A webUI serves pages about the results of searching for issues.
+type webUI struct {
+	defaultQuery string  // used when a request has no q
+	mirror       *Mirror // the source of issues, if -offline
+	cache        *webCache
+}
+
+func serve(addr, defaultQuery string, mirror *Mirror) error {
+	ui := &webUI{defaultQuery, mirror, &webCache{ttl: *cacheTTL, entries: make(map[string]*webCacheEntry)}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ui.list)
+	mux.HandleFunc("/issue/", ui.issue)
+	mux.HandleFunc("/milestones", ui.milestones)
+	mux.HandleFunc("/users", ui.users)
+	log.Printf("serving on http://%s/", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// search returns the cached results of the request's query.
+func (ui *webUI) search(r *http.Request) (string, *IssuesSearchResult, error) {
+	q := strings.TrimSpace(r.FormValue("q"))
+	if q == "" {
+		q = ui.defaultQuery
+	}
+	if q == "" {
+		return q, &IssuesSearchResult{}, nil
+	}
+	v, err := ui.cache.get("search:"+q, func() (interface{}, error) {
+		return source.SearchIssues(strings.Fields(q), *limit)
+	})
+	if err != nil {
+		return q, nil, err
+	}
+	return q, v.(*IssuesSearchResult), nil
+}
+
+// sortKeys are the ways the issue list can be sorted. The column
+// headings link to them, and the current one again, reversed ("-age").
+var sortKeys = []struct {
+	name string
+	less func(a, b *Issue) bool
+}{
+	{"number", func(a, b *Issue) bool { return a.Number < b.Number }},
+	{"state", func(a, b *Issue) bool { return a.State < b.State }},
+	{"user", func(a, b *Issue) bool { return a.User.Login < b.User.Login }},
+	{"age", func(a, b *Issue) bool { return a.CreatedAt.After(b.CreatedAt) }}, // youngest first
+}
+
+type column struct {
+	Name  string
+	URL   string
+	Arrow string // marks the column sorted by
+}
+
+func (ui *webUI) list(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	q, result, err := ui.search(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Sort a copy, as the result is shared through the cache.
+	items := append([]*Issue(nil), result.Items...)
+	by := r.FormValue("sort")
+	var columns []column
+	for _, key := range sortKeys {
+		col := column{Name: key.name}
+		next := key.name
+		switch by {
+		case key.name:
+			less := key.less
+			sort.SliceStable(items, func(i, j int) bool { return less(items[i], items[j]) })
+			col.Arrow, next = " ▲", "-"+key.name
+		case "-" + key.name:
+			less := key.less
+			sort.SliceStable(items, func(i, j int) bool { return less(items[j], items[i]) })
+			col.Arrow = " ▼"
+		}
+		col.URL = "/?" + url.Values{"q": {q}, "sort": {next}}.Encode()
+		columns = append(columns, col)
+	}
+
+	ui.render(w, "issueList", struct {
+		Query   string
+		Result  *IssuesSearchResult
+		Items   []*Issue
+		Columns []column
+		Mirror  *Mirror
+	}{q, result, items, columns, ui.mirror})
+}
+
+// issue serves /issue/owner/name/number.
+func (ui *webUI) issue(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/issue/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	number, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	owner, name := parts[0], parts[1]
+	// Only show the issues the UI lists, rather than fetch any issue
+	// of any repository on behalf of whoever asks.
+	if ok, err := ui.lists(r, owner+"/"+name, number); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := fmt.Sprintf("issue:%s/%s/%d", owner, name, number)
+	v, err := ui.cache.get(key, func() (interface{}, error) {
+		return source.GetIssue(owner, name, number)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	issue := v.(*Issue)
+
+	// Rendering the markdown takes GitHub, so offline it is shown as is.
+	body := htmltemplate.HTML("<pre>" + htmltemplate.HTMLEscapeString(issue.Body) + "</pre>")
+	if ui.mirror == nil {
+		sum := sha256.Sum256([]byte(issue.Repo() + "\n" + issue.Body))
+		v, err := ui.cache.get("markdown:"+hex.EncodeToString(sum[:]), func() (interface{}, error) {
+			return DefaultClient.RenderMarkdown(issue.Body, issue.Repo())
+		})
+		if err == nil {
+			body = htmltemplate.HTML(v.(string)) // sanitized by GitHub
+		} else {
+			log.Print(err) // show it unrendered
+		}
+	}
+
+	q := r.FormValue("q")
+	if q == "" {
+		q = ui.defaultQuery
+	}
+	ui.render(w, "issue", struct {
+		Query string
+		Issue *Issue
+		Body  htmltemplate.HTML
+	}{q, issue, body})
+}
+
+// lists reports whether the issue number of repo is among those the UI
+// lists: in the mirror's repository if offline, or else in the (cached)
+// results of the request's query.
+func (ui *webUI) lists(r *http.Request, repo string, number int) (bool, error) {
+	if ui.mirror != nil {
+		return repo == ui.mirror.Repo, nil
+	}
+	_, result, err := ui.search(r)
+	if err != nil {
+		return false, err
+	}
+	for _, issue := range result.Items {
+		if issue.Repo() == repo && issue.Number == number {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// A group is a heading on the milestone or user index page,
+// with the issues under it.
+type group struct {
+	ID, Name, URL string
+	Items         []*Issue
+}
+
+func (ui *webUI) milestones(w http.ResponseWriter, r *http.Request) {
+	ui.groups(w, r, "Milestones", func(issue *Issue) group {
+		m := issue.Milestone
+		if m == nil {
+			return group{ID: "none", Name: "No milestone"}
+		}
+		return group{ID: fmt.Sprintf("m%d", m.Number), Name: m.Title + " (" + m.State + ")", URL: m.HTMLURL}
+	})
+}
+
+func (ui *webUI) users(w http.ResponseWriter, r *http.Request) {
+	ui.groups(w, r, "Users", func(issue *Issue) group {
+		return group{ID: issue.User.Login, Name: issue.User.Login, URL: issue.User.HTMLURL}
+	})
+}
+
+// groups serves an index page of the search results, grouped by the
+// heading that of returns for each issue, in order of their names.
+func (ui *webUI) groups(w http.ResponseWriter, r *http.Request, title string, of func(*Issue) group) {
+	q, result, err := ui.search(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	byID := make(map[string]*group)
+	var groups []*group
+	for _, issue := range result.Items {
+		g := of(issue)
+		if byID[g.ID] == nil {
+			byID[g.ID] = &g
+			groups = append(groups, &g)
+		}
+		byID[g.ID].Items = append(byID[g.ID].Items, issue)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	ui.render(w, "groups", struct {
+		Query  string
+		Title  string
+		Groups []*group
+	}{q, title, groups})
+}
+
+func (ui *webUI) render(w http.ResponseWriter, page string, data interface{}) {
+	var buf bytes.Buffer
+	if err := pages.ExecuteTemplate(&buf, page, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
 }
@@ -0,0 +1,275 @@
+// The programs of this chapter share a directory, so test this one
+// on its own:
+//
+//	go test github.go github_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSearch stands in for GitHub's search endpoint. It serves pages
+// of perPage issues, linking each to the next up to pages, and refuses
+// the requests numbered in limited as over the rate limit, with the
+// limit resetting after reset.
+type fakeSearch struct {
+	pages, perPage int
+	limited        map[int]bool
+	reset          time.Duration
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (f *fakeSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	n := len(f.requests)
+	f.mu.Unlock()
+
+	if f.limited[n] {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(f.reset).Unix(), 10))
+		http.Error(w, `{"message": "API rate limit exceeded"}`, http.StatusForbidden)
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page == 0 {
+		page = 1
+	}
+	if page < f.pages {
+		next := fmt.Sprintf("http://%s/search/issues?q=%s&page=%d", r.Host, url.QueryEscape(r.FormValue("q")), page+1)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <http://%s/search/issues?page=%d>; rel="last"`, next, r.Host, f.pages))
+	}
+	var items []string
+	for i := 1; i <= f.perPage; i++ {
+		items = append(items, fmt.Sprintf(`{"number": %d, "title": "issue %d"}`, page*100+i, page*100+i))
+	}
+	fmt.Fprintf(w, `{"total_count": %d, "items": [%s]}`, f.pages*f.perPage, strings.Join(items, ","))
+}
+
+func TestSearchIssuesPages(t *testing.T) {
+	fake := &fakeSearch{pages: 3, perPage: 2}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := &Client{APIURL: srv.URL, Token: "secret"}
+
+	result, err := c.SearchIssues([]string{"repo:a/b", "json"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, item := range result.Items {
+		got = append(got, item.Number)
+	}
+	if want := []int{101, 102, 201}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("issues = %v; want %v", got, want)
+	}
+	if result.TotalCount != 6 {
+		t.Errorf("TotalCount = %d; want 6", result.TotalCount)
+	}
+	if len(fake.requests) != 2 {
+		t.Errorf("made %d requests; want 2, stopping at the limit", len(fake.requests))
+	}
+	for _, r := range fake.requests {
+		if got := r.Header.Get("Authorization"); got != "token secret" {
+			t.Errorf("Authorization = %q; want %q", got, "token secret")
+		}
+		if got := r.FormValue("q"); got != "repo:a/b json" {
+			t.Errorf("q = %q; want %q", got, "repo:a/b json")
+		}
+	}
+}
+
+func TestSearchIssuesAllPages(t *testing.T) {
+	fake := &fakeSearch{pages: 3, perPage: 2}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := &Client{APIURL: srv.URL}
+
+	result, err := c.SearchIssues([]string{"x"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 6 || len(fake.requests) != 3 {
+		t.Errorf("got %d issues in %d requests; want 6 in 3", len(result.Items), len(fake.requests))
+	}
+	if got := fake.requests[0].Header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q without a token; want none", got)
+	}
+}
+
+func TestSearchIssuesRateLimited(t *testing.T) {
+	fake := &fakeSearch{pages: 2, perPage: 2, limited: map[int]bool{2: true}, reset: time.Second}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := &Client{APIURL: srv.URL, MaxWait: 5 * time.Second}
+
+	start := time.Now()
+	result, err := c.SearchIssues([]string{"x"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 4 {
+		t.Errorf("got %d issues; want 4", len(result.Items))
+	}
+	if len(fake.requests) != 3 {
+		t.Errorf("made %d requests; want 3, retrying the refused one", len(fake.requests))
+	}
+	if fake.requests[1].URL.String() != fake.requests[2].URL.String() {
+		t.Errorf("retried %s; want %s", fake.requests[2].URL, fake.requests[1].URL)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("retried after %s; want a wait for the reset", d)
+	}
+}
+
+func TestSearchIssuesRateLimitTooLong(t *testing.T) {
+	fake := &fakeSearch{pages: 1, perPage: 2, limited: map[int]bool{1: true}, reset: time.Hour}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := &Client{APIURL: srv.URL, MaxWait: time.Minute}
+
+	start := time.Now()
+	_, err := c.SearchIssues([]string{"x"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "rate limit exceeded") {
+		t.Errorf("err = %v; want rate limit exceeded", err)
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("made %d requests; want 1", len(fake.requests))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %s; want at once", d)
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	for _, test := range []struct{ link, want string }{
+		{"", ""},
+		{`<https://x/?page=2>; rel="next", <https://x/?page=5>; rel="last"`, "https://x/?page=2"},
+		{`<https://x/?page=1>; rel="prev", <https://x/?page=3>; rel="next"`, "https://x/?page=3"},
+		{`<https://x/?page=1>; rel="first", <https://x/?page=4>; rel="prev"`, ""},
+	} {
+		if got := nextPage(test.link); got != test.want {
+			t.Errorf("nextPage(%q) = %q; want %q", test.link, got, test.want)
+		}
+	}
+}
+
+func TestWebCacheBounded(t *testing.T) {
+	c := &webCache{ttl: time.Hour, entries: make(map[string]*webCacheEntry)}
+	fetches := 0
+	fetch := func() (interface{}, error) {
+		fetches++
+		return fetches, nil
+	}
+	for i := 0; i < 2*maxWebCacheEntries; i++ {
+		c.get(fmt.Sprintf("search:%d", i), fetch)
+	}
+	if len(c.entries) > maxWebCacheEntries {
+		t.Errorf("%d entries; want at most %d", len(c.entries), maxWebCacheEntries)
+	}
+	last := fmt.Sprintf("search:%d", 2*maxWebCacheEntries-1)
+	if v, _ := c.get(last, fetch); v != 2*maxWebCacheEntries {
+		t.Errorf("get(%s) = %v; want the cached %d", last, v, 2*maxWebCacheEntries)
+	}
+
+	// Expired entries make way before live ones.
+	c = &webCache{ttl: -time.Second, entries: make(map[string]*webCacheEntry)}
+	for i := 0; i < maxWebCacheEntries; i++ {
+		c.get(fmt.Sprintf("old:%d", i), fetch)
+	}
+	c.ttl = time.Hour
+	c.get("new", fetch)
+	if len(c.entries) != 1 {
+		t.Errorf("%d entries after the expired were evicted; want 1", len(c.entries))
+	}
+}
+
+func TestWebCacheFetchesOnce(t *testing.T) {
+	c := &webCache{ttl: time.Hour, entries: make(map[string]*webCacheEntry)}
+	var mu sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	fetch := func() (interface{}, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		<-release
+		return "result", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.get("search:go", fetch); v != "result" || err != nil {
+				t.Errorf("get = %v, %v; want result, <nil>", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let them all ask
+	close(release)
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("%d fetches; want 1", fetches)
+	}
+
+	// A failure reaches those waiting but isn't remembered.
+	fail := func() (interface{}, error) { return nil, fmt.Errorf("boom") }
+	if _, err := c.get("search:bad", fail); err == nil {
+		t.Error("get of a failing fetch succeeded")
+	}
+	if _, ok := c.entries["search:bad"]; ok {
+		t.Error("failure was cached")
+	}
+}
+
+// fakeSource is an issueSource holding one search result.
+type fakeSource struct{ items []*Issue }
+
+func (s fakeSource) SearchIssues(terms []string, limit int) (*IssuesSearchResult, error) {
+	return &IssuesSearchResult{TotalCount: len(s.items), Items: s.items}, nil
+}
+
+func (s fakeSource) GetIssue(owner, repo string, number int) (*Issue, error) {
+	return nil, fmt.Errorf("GetIssue called")
+}
+
+func TestWebUIListsOnlyItsIssues(t *testing.T) {
+	defer func(saved issueSource) { source = saved }(source)
+	source = fakeSource{[]*Issue{
+		{Number: 1, RepositoryURL: "https://api.github.com/repos/golang/go"},
+	}}
+	ui := &webUI{defaultQuery: "repo:golang/go", cache: &webCache{ttl: time.Hour, entries: make(map[string]*webCacheEntry)}}
+	offline := &webUI{mirror: &Mirror{Repo: "golang/go"}}
+
+	for _, test := range []struct {
+		ui     *webUI
+		repo   string
+		number int
+		want   bool
+	}{
+		{ui, "golang/go", 1, true},
+		{ui, "golang/go", 2, false},
+		{ui, "evil/repo", 1, false},
+		{offline, "golang/go", 2, true},
+		{offline, "evil/repo", 1, false},
+	} {
+		r := httptest.NewRequest("GET", "/issue/"+test.repo+"/"+strconv.Itoa(test.number), nil)
+		got, err := test.ui.lists(r, test.repo, test.number)
+		if err != nil || got != test.want {
+			t.Errorf("lists(%s#%d), offline=%t = %t, %v; want %t",
+				test.repo, test.number, test.ui.mirror != nil, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type client chan<- string // an outgoing message channel
+
+// A registration asks the broadcaster to admit cli under name.
+type registration struct {
+	name  string
+	cli   client
+	conn  net.Conn // closed by the broadcaster to disconnect a slow client
+	reply chan<- error
+}
+
+// A rename asks the broadcaster to move a client from one name to another.
+type rename struct {
+	old, new string
+	reply    chan<- error
+}
+
+// A privateMsg is a message for a single named client.
+type privateMsg struct {
+	from, to, text string
+	reply          chan<- error
+}
+
+// A message is a line of chat for everyone in the sender's room.
+type message struct {
+	from, text string
+}
+
+// A move asks the broadcaster to take a client to another room.
+type move struct {
+	name, room string
+	reply      chan<- error
+}
+
+// A roster asks for the names of the clients in the same room as name.
+type roster struct {
+	name  string
+	reply chan<- []string
+}
+
+// A summary is the broadcaster's account of its work, given at shutdown.
+type summary struct {
+	clients, relayed, dropped int
+}
+
+var (
+	entering = make(chan registration)
+	leaving  = make(chan string) // names of departing clients
+	renaming = make(chan rename)
+	moving   = make(chan move)
+	messages = make(chan message) // all incoming messages
+	private  = make(chan privateMsg)
+	listing  = make(chan roster)          // requests for the members of a client's room
+	roomList = make(chan chan<- []string) // requests for the names and sizes of all rooms
+	quitting = make(chan chan<- summary)  // a request to disconnect everyone
+	closing  = make(chan struct{})        // closed once the server is shutting down
+	starting = make(chan chan<- bool)     // requests to count a new clientWriter
+	writers  sync.WaitGroup               // running clientWriters, counted by the broadcaster
+)
+
+const lobby = "lobby" // the room every client starts in
+
+// A member is a registered client and the room it is in.
+type member struct {
+	cli     client
+	conn    net.Conn
+	room    string
+	dropped int  // messages that didn't fit in cli's queue
+	kicked  bool // conn has been closed for being too slow
+}
+
+// A hub is the broadcaster's view of who is connected and where.
+// It is only ever touched by the broadcaster goroutine.
+type hub struct {
+	clients map[string]*member         // all connected clients, by name
+	rooms   map[string]map[string]bool // member names, by room
+	dropped int                        // messages dropped for all clients
+	relayed int                        // messages sent on behalf of clients
+	hist    *history
+}
+
+// send queues msg for the client name without waiting.
+// If its queue is full the message is dropped, and under the
+// disconnect policy the client is disconnected too.
+func (h *hub) send(name, msg string) {
+	m := h.clients[name]
+	select {
+	case m.cli <- msg:
+		return
+	default:
+	}
+	m.dropped++
+	h.dropped++
+	if *slowPolicy == "disconnect" && !m.kicked {
+		log.Printf("disconnecting slow client %s", name)
+		m.kicked = true
+		m.conn.Close() // handleConn notices and leaves
+	}
+}
+
+// announce sends msg to every member of room.
+func (h *hub) announce(room, msg string) {
+	for name := range h.rooms[room] {
+		h.send(name, msg)
+	}
+}
+
+// enter puts the client name into room, telling those already there.
+func (h *hub) enter(name, room string) {
+	h.announce(room, name+" has joined "+room)
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[string]bool)
+	}
+	h.rooms[room][name] = true
+	h.clients[name].room = room
+	// Replay as a single message so it can't be partly dropped.
+	if past := h.hist.recent[room]; len(past) > 0 {
+		var lines []string
+		for _, e := range past {
+			lines = append(lines, e.String())
+		}
+		h.send(name, strings.Join(lines, "\n"))
+	}
+}
+
+// part takes the client name out of its room, telling those who remain.
+// Rooms other than the lobby are discarded once empty.
+func (h *hub) part(name string) {
+	room := h.clients[name].room
+	delete(h.rooms[room], name)
+	if len(h.rooms[room]) == 0 && room != lobby {
+		delete(h.rooms, room)
+	}
+	h.announce(room, name+" has left "+room)
+}
+
+func broadcaster(hist *history) {
+	h := &hub{
+		clients: make(map[string]*member),
+		rooms:   make(map[string]map[string]bool),
+		hist:    hist,
+	}
+	reported := 0 // h.dropped as of the last report
+	tick := time.Tick(*statsPeriod)
+	for {
+		select {
+		case msg := <-messages:
+			// Broadcast incoming message to the outgoing message
+			// channel of every client in the sender's room
+			room := h.clients[msg.from].room
+			h.hist.add(entry{time.Now(), room, msg.from, msg.text})
+			h.announce(room, msg.from+": "+msg.text)
+			h.relayed++
+		case r := <-entering:
+			if isClosing() {
+				r.reply <- fmt.Errorf("server is shutting down")
+				continue
+			}
+			if _, ok := h.clients[r.name]; ok {
+				r.reply <- fmt.Errorf("name %q is already in use", r.name)
+				continue
+			}
+			h.clients[r.name] = &member{cli: r.cli, conn: r.conn}
+			h.enter(r.name, lobby)
+			r.reply <- nil
+		case name := <-leaving:
+			if !isClosing() {
+				h.part(name)
+			}
+			m := h.clients[name]
+			close(m.cli) // closes the client's outgoing message channel
+			delete(h.clients, name)
+			if m.dropped > 0 {
+				log.Printf("%s left; %d messages dropped", name, m.dropped)
+			}
+		case r := <-renaming:
+			if _, ok := h.clients[r.new]; ok {
+				r.reply <- fmt.Errorf("name %q is already in use", r.new)
+				continue
+			}
+			m := h.clients[r.old]
+			delete(h.clients, r.old)
+			delete(h.rooms[m.room], r.old)
+			h.clients[r.new] = m
+			h.rooms[m.room][r.new] = true
+			h.announce(m.room, r.old+" is now known as "+r.new)
+			r.reply <- nil
+		case mv := <-moving:
+			if h.clients[mv.name].room == mv.room {
+				mv.reply <- fmt.Errorf("already in %s", mv.room)
+				continue
+			}
+			h.part(mv.name)
+			h.enter(mv.name, mv.room)
+			mv.reply <- nil
+		case m := <-private:
+			if _, ok := h.clients[m.to]; !ok {
+				m.reply <- fmt.Errorf("no such user %q", m.to)
+				continue
+			}
+			h.send(m.to, m.from+" (private): "+m.text)
+			h.relayed++
+			m.reply <- nil
+		case w := <-listing:
+			var names []string
+			for name := range h.rooms[h.clients[w.name].room] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			w.reply <- names
+		case reply := <-roomList:
+			var rooms []string
+			for room, members := range h.rooms {
+				rooms = append(rooms, fmt.Sprintf("%s (%d)", room, len(members)))
+			}
+			sort.Strings(rooms)
+			reply <- rooms
+		case reply := <-starting:
+			// Counting writers here, where closing is closed, keeps
+			// writers.Add from racing with the writers.Wait that
+			// follows in shutdown.
+			if isClosing() {
+				reply <- false
+				continue
+			}
+			writers.Add(1)
+			reply <- true
+		case reply := <-quitting:
+			// Every handleConn now stops reading and leaves,
+			// which closes its queue once the notice is sent.
+			close(closing)
+			for name := range h.clients {
+				h.send(name, "server is shutting down")
+			}
+			reply <- summary{len(h.clients), h.relayed, h.dropped}
+		case <-tick:
+			if h.dropped != reported {
+				log.Printf("%d clients; %d messages dropped (%d since last report)",
+					len(h.clients), h.dropped, h.dropped-reported)
+				reported = h.dropped
+			}
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Chat is a server that lets clients chat with each other in rooms,
+// over TCP or, from a browser, over WebSocket.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	queueLen     = flag.Int("queue", 16, "number of outgoing messages buffered per client")
+	slowPolicy   = flag.String("slow", "drop", "what to do when a client's queue is full: drop or disconnect")
+	idleTimeout  = flag.Duration("idle", 5*time.Minute, "disconnect clients that send nothing for this long")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "give up on a client that takes longer than this to accept a message")
+	statsPeriod  = flag.Duration("stats", time.Minute, "how often to log the number of dropped messages")
+	historyFile  = flag.String("history", "chat.log", "file to which messages are appended (empty for none)")
+	replayLen    = flag.Int("replay", 20, "number of past messages shown on entering a room")
+	httpAddr     = flag.String("http", "localhost:8080", "address for browser clients (empty for none)")
+	drainTimeout = flag.Duration("drain", 5*time.Second, "how long to spend flushing queued messages on shutdown")
+	certFile     = flag.String("cert", "", "TLS certificate file; serve plaintext if empty")
+	keyFile      = flag.String("key", "", "TLS private key file")
+	genCert      = flag.Bool("gencert", false, "write a self-signed certificate for localhost to -cert and -key, then exit")
+	usersFile    = flag.String("users", "", "credentials file; if set, clients must log in")
+	addUser      = flag.String("adduser", "", "append a credential for this name, read from stdin, to -users, then exit")
+)
+
+// isClosing reports whether the server is shutting down.
+// Check it after setting a read deadline: if it reports false,
+// the deadline is cut short by the watcher in handleConn.
+func isClosing() bool {
+	select {
+	case <-closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func handleConn(conn net.Conn) {
+	reply := make(chan bool)
+	starting <- reply
+	if !<-reply {
+		conn.Close() // too late; the server is shutting down
+		return
+	}
+	ch := make(chan string, *queueLen) // outgoing client messages
+	go clientWriter(conn, ch)          // closes conn once ch is closed
+
+	// Interrupt any pending read when the server shuts down.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-closing:
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	input := bufio.NewScanner(conn)
+	who := handshake(conn, input, ch)
+	if who == "" {
+		close(ch) // never registered, so the broadcaster won't close it
+		return
+	}
+	ch <- "You are " + who
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(*idleTimeout))
+		if isClosing() || !input.Scan() {
+			if err, ok := input.Err().(net.Error); ok && err.Timeout() && !isClosing() {
+				ch <- fmt.Sprintf("disconnected after %s idle", *idleTimeout)
+			}
+			break
+		}
+		line := input.Text()
+		if !strings.HasPrefix(line, "/") {
+			messages <- message{who, line}
+			continue
+		}
+		var ok bool
+		if who, ok = command(who, line, ch); !ok {
+			break
+		}
+	}
+
+	leaving <- who
+}
+
+// handshake asks a new client for a name until it picks one the
+// broadcaster accepts, and returns it. If there are credentials,
+// the client must also log in as that name. It returns "" if the
+// client disconnects or fails to log in first.
+func handshake(conn net.Conn, input *bufio.Scanner, ch client) string {
+	failures := 0
+	for {
+		ch <- "Enter your name:"
+		conn.SetReadDeadline(time.Now().Add(*idleTimeout))
+		if isClosing() || !input.Scan() {
+			return ""
+		}
+		name := strings.TrimSpace(input.Text())
+		if err := checkName(name); err != nil {
+			ch <- "error: " + err.Error()
+			continue
+		}
+		if creds != nil {
+			ch <- "Password or token:"
+			conn.SetReadDeadline(time.Now().Add(*idleTimeout))
+			if isClosing() || !input.Scan() {
+				return ""
+			}
+			if !creds.check(name, input.Text()) {
+				log.Printf("%s: failed login as %s", conn.RemoteAddr(), name)
+				select {
+				case <-time.After(failedLogin(conn.RemoteAddr())):
+				case <-closing:
+					return ""
+				}
+				if failures++; failures == maxLoginFailures {
+					ch <- "error: too many failed logins"
+					return ""
+				}
+				ch <- "error: login incorrect"
+				continue
+			}
+			loggedIn(conn.RemoteAddr())
+		}
+		reply := make(chan error, 1)
+		entering <- registration{name, ch, conn, reply}
+		if err := <-reply; err != nil {
+			ch <- "error: " + err.Error()
+			continue
+		}
+		return name
+	}
+}
+
+func checkName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("name must not be empty")
+	case strings.ContainsAny(name, " \t"):
+		return fmt.Errorf("name %q must be a single word", name)
+	case strings.HasPrefix(name, "/"):
+		return fmt.Errorf("name %q must not start with /", name)
+	}
+	return nil
+}
+
+// command carries out the slash command in line for the client named who.
+// It returns the client's name, which /nick may have changed,
+// and false if the client asked to quit.
+func command(who, line string, ch client) (string, bool) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/nick":
+		if creds != nil {
+			ch <- "error: names can't be changed once logged in"
+			break
+		}
+		if len(fields) != 2 {
+			ch <- "usage: /nick <name>"
+			break
+		}
+		if err := checkName(fields[1]); err != nil {
+			ch <- "error: " + err.Error()
+			break
+		}
+		reply := make(chan error, 1)
+		renaming <- rename{who, fields[1], reply}
+		if err := <-reply; err != nil {
+			ch <- "error: " + err.Error()
+			break
+		}
+		who = fields[1]
+		ch <- "You are " + who
+	case "/who":
+		reply := make(chan []string, 1)
+		listing <- roster{who, reply}
+		ch <- "here: " + strings.Join(<-reply, ", ")
+	case "/join", "/leave":
+		room := lobby
+		if fields[0] == "/join" {
+			if len(fields) != 2 {
+				ch <- "usage: /join <room>"
+				break
+			}
+			room = fields[1]
+		}
+		if err := checkName(room); err != nil {
+			ch <- "error: " + err.Error()
+			break
+		}
+		reply := make(chan error, 1)
+		moving <- move{who, room, reply}
+		if err := <-reply; err != nil {
+			ch <- "error: " + err.Error()
+			break
+		}
+		ch <- "You are in " + room
+	case "/rooms":
+		reply := make(chan []string, 1)
+		roomList <- reply
+		ch <- "rooms: " + strings.Join(<-reply, ", ")
+	case "/msg":
+		if len(fields) < 3 {
+			ch <- "usage: /msg <user> <text>"
+			break
+		}
+		// keep the text as typed rather than rejoining fields
+		rest := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		text := strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+		reply := make(chan error, 1)
+		private <- privateMsg{who, fields[1], text, reply}
+		if err := <-reply; err != nil {
+			ch <- "error: " + err.Error()
+		}
+	case "/quit":
+		ch <- "bye"
+		return who, false
+	default:
+		ch <- "unknown command " + fields[0] + "; try /nick, /who, /msg, /join, /leave, /rooms or /quit"
+	}
+	return who, true
+}
+
+func clientWriter(conn net.Conn, ch <-chan string) {
+	defer writers.Done()
+	for msg := range ch {
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		if _, err := fmt.Fprintln(conn, msg); err != nil {
+			break
+		}
+	}
+	conn.Close() // also wakes handleConn if it is still reading
+	for range ch {
+		// discard messages until the broadcaster closes ch
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *slowPolicy != "drop" && *slowPolicy != "disconnect" {
+		log.Fatalf("chat: unknown -slow policy %q", *slowPolicy)
+	}
+	if *queueLen < 0 {
+		log.Fatalf("chat: -queue must not be negative, got %d", *queueLen)
+	}
+	if *replayLen < 0 {
+		log.Fatalf("chat: -replay must not be negative, got %d", *replayLen)
+	}
+	if *genCert {
+		if *certFile == "" || *keyFile == "" {
+			log.Fatal("chat: -gencert needs -cert and -key")
+		}
+		if err := writeSelfSignedCert(*certFile, *keyFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *addUser != "" {
+		if *usersFile == "" {
+			log.Fatal("chat: -adduser needs -users")
+		}
+		input := bufio.NewScanner(os.Stdin)
+		input.Scan()
+		if err := appendCredential(*usersFile, *addUser, input.Text()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *usersFile != "" {
+		var err error
+		if creds, err = loadCredentials(*usersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	hist, err := openHistory(*historyFile, *replayLen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "localhost:8000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Addr: *httpAddr}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		listener = tls.NewListener(listener, config)
+		srv.TLSConfig = config
+		// WebSockets need a connection to take over, which HTTP/2 can't give.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	go broadcaster(hist)
+	if *httpAddr != "" {
+		go serveHTTP(srv)
+	}
+	go func() {
+		for {
+			// waiting for connection
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // shutting down
+			}
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			// handle connection in the background
+			go handleConn(conn)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	log.Println("receive signal", sig)
+	shutdown(listener, srv)
+}
+
+// shutdown stops accepting connections, tells every client the server
+// is going away, and gives their queues until -drain to empty.
+func shutdown(listener net.Listener, srv *http.Server) {
+	start := time.Now()
+	listener.Close()
+	srv.Close() // hijacked WebSocket connections are left to the broadcaster
+
+	reply := make(chan summary)
+	quitting <- reply
+	sum := <-reply
+
+	flushed := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(*drainTimeout):
+		log.Printf("gave up flushing after %s", *drainTimeout)
+	}
+	log.Printf("shut down in %s: disconnected %d clients, relayed %d messages, dropped %d",
+		time.Since(start), sum.clients, sum.relayed, sum.dropped)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// creds holds the credentials read from -users, or nil if clients
+// may use any free name. It is not modified once the server starts.
+var creds credentials
+
+// Clients log in with a password or token checked against a
+// credentials file. Each line holds a name, the key-derivation
+// function (only pbkdf2-sha256 for now), its iteration count, a random
+// salt, and the key it derives from the secret, all space-separated.
+// The function is deliberately slow, to make a leaked file expensive
+// to attack. A name may have several lines, say one password and some
+// tokens. Lines starting with # are ignored.
+
+const (
+	maxLoginFailures = 3
+	kdf              = "pbkdf2-sha256"
+	kdfIterations    = 600000 // as OWASP recommends for PBKDF2-HMAC-SHA256
+)
+
+// A credential is one stored secret for a name.
+type credential struct {
+	iter      int
+	salt, key []byte
+}
+
+// derive returns the key derived from secret with c's parameters.
+func (c credential) derive(secret string) []byte {
+	key, err := pbkdf2.Key(sha256.New, secret, c.salt, c.iter, sha256.Size)
+	if err != nil {
+		panic(err) // only for parameters no credential has
+	}
+	return key
+}
+
+type credentials map[string][]credential
+
+func loadCredentials(path string) (credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	creds := make(credentials)
+	input := bufio.NewScanner(f)
+	for n := 1; input.Scan(); n++ {
+		line := strings.TrimSpace(input.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: want name, %s, iterations, salt and key (re-add old entries with -adduser)", path, n, kdf)
+		}
+		if fields[1] != kdf {
+			return nil, fmt.Errorf("%s:%d: unknown key-derivation function %q", path, n, fields[1])
+		}
+		iter, err := strconv.Atoi(fields[2])
+		salt, err1 := hex.DecodeString(fields[3])
+		key, err2 := hex.DecodeString(fields[4])
+		if err != nil || iter < 1 || err1 != nil || err2 != nil || len(salt) == 0 || len(key) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: malformed iterations, salt or key", path, n)
+		}
+		creds[fields[0]] = append(creds[fields[0]], credential{iter, salt, key})
+	}
+	return creds, input.Err()
+}
+
+// unknownName stands in for the credentials of a name that has none,
+// so that checking them takes as long as for a real name, and the
+// time taken doesn't tell which names exist.
+var unknownName = []credential{{kdfIterations, make([]byte, 16), make([]byte, sha256.Size)}}
+
+// check reports whether secret is one of name's credentials.
+func (creds credentials) check(name, secret string) bool {
+	ok := false
+	known := creds[name]
+	if len(known) == 0 {
+		known = unknownName
+	}
+	for _, c := range known {
+		if subtle.ConstantTimeCompare(c.derive(secret), c.key) == 1 {
+			ok = true
+		}
+	}
+	return ok && len(creds[name]) > 0
+}
+
+// A failed login is answered only after a delay that doubles with
+// each failure from the same address, up to maxLoginDelay, so that
+// guessing secrets stays slow however many connections are used.
+// An address is forgiven when it logs in, or after a quiet spell.
+const (
+	loginDelay         = time.Second
+	maxLoginDelay      = 30 * time.Second
+	loginFailureWindow = 15 * time.Minute
+)
+
+var loginFailures = struct {
+	sync.Mutex
+	byHost map[string]loginFailure
+}{byHost: make(map[string]loginFailure)}
+
+type loginFailure struct {
+	n    int       // failures in a row
+	last time.Time // the latest of them
+}
+
+// failedLogin records a failed login from addr and returns how long
+// to wait before saying so.
+func failedLogin(addr net.Addr) time.Duration {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	now := time.Now()
+	for host, f := range loginFailures.byHost {
+		if now.Sub(f.last) > loginFailureWindow {
+			delete(loginFailures.byHost, host)
+		}
+	}
+	host := hostOf(addr)
+	f := loginFailures.byHost[host]
+	f.n++
+	f.last = now
+	loginFailures.byHost[host] = f
+	delay := maxLoginDelay
+	if f.n < 16 { // beyond which the shift overflows
+		if d := loginDelay << (f.n - 1); d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// loggedIn forgets the failed logins from addr.
+func loggedIn(addr net.Addr) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	delete(loginFailures.byHost, hostOf(addr))
+}
+
+// hostOf returns the host part of addr, so that the ports of
+// different connections from one machine don't tell them apart.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// appendCredential adds a line for name and secret to the credentials file at path.
+func appendCredential(path, name, secret string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	c := credential{iter: kdfIterations, salt: make([]byte, 16)}
+	if _, err := rand.Read(c.salt); err != nil {
+		return err
+	}
+	c.key = c.derive(secret)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "%s %s %d %x %x\n", name, kdf, c.iter, c.salt, c.key)
+	return f.Close()
+}
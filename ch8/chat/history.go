@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// An entry is one message as recorded in the history file.
+type entry struct {
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+}
+
+func (e entry) String() string {
+	return e.Time.Format("[Jan 2 15:04] ") + e.From + ": " + e.Text
+}
+
+// A history is an append-only log of messages, plus the last
+// few of each room kept in memory for replay.
+type history struct {
+	enc    *json.Encoder // writes to the log; nil if there is none
+	max    int           // the number of recent messages kept per room
+	recent map[string][]entry
+}
+
+// openHistory loads the recent messages of each room from the log
+// file at path, creating it if need be, and opens it for appending.
+// An empty path means messages are remembered only until exit.
+func openHistory(path string, max int) (*history, error) {
+	h := &history{max: max, recent: make(map[string][]entry)}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	input := bufio.NewReaderSize(f, maxEntry)
+	for n := 1; ; n++ {
+		line, err := input.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Printf("%s:%d: skipping entry longer than %d bytes", path, n, maxEntry)
+			for err == bufio.ErrBufferFull {
+				_, err = input.ReadSlice('\n')
+			}
+		} else if len(line) > 0 {
+			var e entry
+			if err := json.Unmarshal(line, &e); err != nil {
+				// most likely a line cut short by a crash
+				log.Printf("%s:%d: skipping bad entry: %v", path, n, err)
+			} else {
+				h.remember(e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	h.enc = json.NewEncoder(f)
+	return h, nil
+}
+
+// maxEntry bounds the length of a line of the history log. A message
+// is at most a line of bufio.MaxScanTokenSize or a frame of maxFrame,
+// which JSON may escape to six times that (\u003c for <).
+const maxEntry = 6*maxFrame + 4096
+
+func (h *history) remember(e entry) {
+	past := append(h.recent[e.Room], e)
+	if len(past) > h.max {
+		past = past[len(past)-h.max:]
+	}
+	h.recent[e.Room] = past
+}
+
+// add records e in the log and among the recent messages of its room.
+func (h *history) add(e entry) {
+	h.remember(e)
+	if h.enc == nil {
+		return
+	}
+	if err := h.enc.Encode(e); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
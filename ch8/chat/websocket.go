@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The WebSocket front-end lets browsers join the same rooms as TCP
+// clients. A wsConn looks to handleConn like any other connection:
+// each text frame it reads is one line of input, and each line
+// written to it is sent as one text frame.
+
+const page = `<!DOCTYPE html>
+<title>chat</title>
+<pre id="log"></pre>
+<form id="form"><input id="line" autocomplete="off" autofocus size="80"></form>
+<script>
+var log = document.getElementById("log");
+var line = document.getElementById("line");
+var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+ws.onmessage = function(e) {
+	log.textContent += e.data + "\n";
+	window.scrollTo(0, document.body.scrollHeight);
+};
+ws.onclose = function() { log.textContent += "(disconnected)\n"; };
+document.getElementById("form").onsubmit = function(e) {
+	e.preventDefault();
+	ws.send(line.value);
+	line.value = "";
+};
+</script>
+`
+
+// WebSocket opcodes (RFC 6455, section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const maxFrame = 64 << 10 // the largest frame payload accepted from a browser
+
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader
+	pending []byte     // unread input, ending in a newline
+	mu      sync.Mutex // guards writes, which come from clientWriter and pongs
+}
+
+// upgrade completes the WebSocket opening handshake for r
+// and takes over its connection.
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("%s: not a WebSocket handshake", r.RemoteAddr)
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%s: WebSocket version %q", r.RemoteAddr, v)
+	}
+	// Browsers let any page open a WebSocket to any server, but say
+	// which site the page came from. Only accept our own page, lest
+	// another site chat in the name of a visitor logged in here.
+	// Clients other than browsers send no Origin.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin WebSocket refused", http.StatusForbidden)
+			return nil, fmt.Errorf("%s: refused WebSocket from origin %s", r.RemoteAddr, origin)
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't take over the connection", http.StatusInternalServerError)
+		return nil, fmt.Errorf("%T is not an http.Hijacker", w)
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: conn, r: rw.Reader}, nil
+}
+
+// Read returns the text of incoming messages, one line per message.
+func (c *wsConn) Read(p []byte) (int, error) {
+	var msg []byte
+	for len(c.pending) == 0 {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case opText, opContinuation:
+			msg = append(msg, payload...)
+			if len(msg) > maxFrame {
+				return 0, fmt.Errorf("websocket: message too long")
+			}
+			if fin {
+				c.pending = append(msg, '\n')
+			}
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+		case opClose:
+			c.writeFrame(opClose, nil)
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxFrame {
+		return false, 0, nil, fmt.Errorf("websocket: %d-byte frame too long", n)
+	}
+	var mask [4]byte
+	if hdr[1]&0x80 != 0 { // browsers always mask their frames
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Write sends p, less its trailing newline, as one text message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	hdr := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Conn.Write(append(hdr, payload...))
+	return err
+}
+
+func serveHTTP(srv *http.Server) {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrade(w, r)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		handleConn(conn)
+	})
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "") // certificates come from TLSConfig
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
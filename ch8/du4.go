@@ -1,120 +0,0 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"sync"
-	"time"
-)
-
-var verbose = flag.Bool("v", false, "show verbose progress messages")
-
-var done = make(chan struct{})
-
-func cancelled() bool {
-	select {
-	case <-done:
-		return true
-	default:
-		return false
-	}
-}
-
-func main() {
-	flag.Parse()
-	// determine the initial directories
-	roots := flag.Args()
-	if len(roots) == 0 {
-		roots = []string{"."}
-	}
-	// Traverse the file tree
-	fileSizes := make(chan int64)
-
-	var wg sync.WaitGroup
-	for _, root := range roots {
-		wg.Add(1)
-		go walkDir(root, &wg, fileSizes)
-	}
-
-	go func() {
-		wg.Wait()
-		close(fileSizes)
-	}()
-
-	// cancel traversal when input is detected
-	go func() {
-		os.Stdin.Read(make([]byte, 1)) // read a single byte
-		close(done)
-	}()
-
-	var tick <-chan time.Time
-	if *verbose {
-		tick = time.Tick(500 * time.Millisecond)
-	}
-	// Print the results
-	var nfiles, nbytes int64
-loop:
-	for {
-		select {
-		case <-done:
-			// drain fileSizes to allow existing goroutines to finish
-			for range fileSizes {
-				// Do nothing
-			}
-		case size, ok := <-fileSizes:
-			if !ok {
-				break loop // fileSizes was closed
-			}
-			nfiles++
-			nbytes += size
-		case <-tick:
-			printDiskUsage(nfiles, nbytes)
-		}
-	}
-
-	printDiskUsage(nfiles, nbytes)
-}
-
-func printDiskUsage(nfiles, nbytes int64) {
-	fmt.Printf("%d files  %.1f GB\n", nfiles, float64(nbytes)/1e9)
-}
-
-func walkDir(dir string, wg *sync.WaitGroup, fileSizes chan<- int64) {
-	defer wg.Done()
-	if cancelled() {
-		return
-	}
-	for _, entry := range dirents(dir) {
-		if entry.IsDir() {
-			wg.Add(1)
-			subdir := filepath.Join(dir, entry.Name())
-			go walkDir(subdir, wg, fileSizes)
-		} else {
-			fileSizes <- entry.Size()
-		}
-	}
-}
-
-var sema = make(chan struct{}, 4)
-
-// dirents returns the entries of directory dir
-func dirents(dir string) []os.FileInfo {
-	select {
-	case sema <- struct{}{}: // acquire token
-	case <-done:
-		return nil // cancelled
-	}
-	defer func() {
-		<-sema // release token
-	}()
-
-	entries, err := ioutil.ReadDir(dir)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "du3: %v\n", err)
-		return nil
-	}
-	return entries
-}
@@ -0,0 +1,928 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	verbose     = flag.Bool("v", false, "show verbose progress messages")
+	top         = flag.Int("top", 0, "list the `N` largest directories and files")
+	depth       = flag.Int("depth", -1, "show a tree of directory totals `N` levels deep")
+	followLinks = flag.Bool("L", false, "follow symbolic links")
+	noFollow    = flag.Bool("P", false, "don't follow symbolic links (the default)")
+	oneFS       = flag.Bool("x", false, "skip directories on other file systems than their root")
+	blocks      = flag.Bool("blocks", false, "total allocated disk space rather than apparent size")
+	format      = flag.String("format", "text", "output `format`: text, or json or csv for per-directory records")
+	save        = flag.String("save", "", "save per-directory totals to `file` for a later -diff")
+	diff        = flag.String("diff", "", "report directories that grew or shrank since the snapshot in `file`")
+	timeout     = flag.Duration("timeout", 0, "give up after `duration` and report what was found so far")
+	jobs        = flag.Int("j", 2*runtime.NumCPU(), "read at most `N` directories at once")
+)
+
+// File selection, in addition to the rules in each directory's .duignore.
+var (
+	excludes  patternList
+	includes  patternList
+	exts      extList
+	minSize   byteSize
+	olderThan age
+)
+
+func init() {
+	flag.Var(&excludes, "exclude", "skip files and directories matching `glob` (repeatable)")
+	flag.Var(&includes, "include", "count only files matching `glob` (repeatable)")
+	flag.Var(&exts, "ext", "count only files with extension `ext` (repeatable)")
+	flag.Var(&minSize, "min-size", "count only files of at least `size` bytes, e.g. 10k or 1.5G")
+	flag.Var(&olderThan, "older", "count only files last modified more than `age` ago, e.g. 30d or 12h")
+}
+
+// Patterns are matched against paths relative to the root, or to the
+// directory of the .duignore file they came from. A pattern with no
+// slash matches a name at any depth.
+type patternList []string
+
+func (l *patternList) String() string { return strings.Join(*l, ",") }
+
+func (l *patternList) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return fmt.Errorf("%q: %v", s, err)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// A pattern is a glob that applies to the paths beneath dir.
+type pattern struct {
+	dir, glob string
+}
+
+func (p pattern) match(path string) bool {
+	rel, err := filepath.Rel(p.dir, path)
+	if err != nil {
+		return false
+	}
+	if !strings.Contains(p.glob, "/") {
+		rel = filepath.Base(rel)
+	}
+	ok, _ := filepath.Match(p.glob, rel)
+	return ok
+}
+
+func matchAny(patterns []pattern, path string) bool {
+	for _, p := range patterns {
+		if p.match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnoreFile returns the patterns in the .duignore file in dir,
+// one per line, ignoring blank lines and those starting with #.
+func readIgnoreFile(dir string) []pattern {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".duignore"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "du4: %v\n", err)
+		return nil
+	}
+	var patterns []pattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "du4: %s/.duignore: %q: %v\n", dir, line, err)
+			continue
+		}
+		patterns = append(patterns, pattern{dir, line})
+	}
+	return patterns
+}
+
+// An extList is a set of file extensions, compared without regard to case.
+type extList []string
+
+func (l *extList) String() string { return strings.Join(*l, ",") }
+
+func (l *extList) Set(s string) error {
+	if !strings.HasPrefix(s, ".") {
+		s = "." + s
+	}
+	*l = append(*l, strings.ToLower(s))
+	return nil
+}
+
+// A byteSize is a number of bytes, which may be given with a
+// decimal unit suffix (k, M, G, T) as formatSize prints them.
+type byteSize int64
+
+func (b *byteSize) String() string { return formatSize(int64(*b)) }
+
+func (b *byteSize) Set(s string) error {
+	mult := 1.0
+	if i := strings.IndexAny(s, "kKMGT"); i >= 0 {
+		mult = map[byte]float64{'k': 1e3, 'K': 1e3, 'M': 1e6, 'G': 1e9, 'T': 1e12}[s[i]]
+		if rest := strings.TrimSuffix(s[i+1:], "B"); rest != "" {
+			return fmt.Errorf("bad size %q", s)
+		}
+		s = s[:i]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("bad size %q", s)
+	}
+	*b = byteSize(f * mult)
+	return nil
+}
+
+// An age is a time.Duration that may also be given in days, like 30d.
+type age time.Duration
+
+func (a *age) String() string { return time.Duration(*a).String() }
+
+func (a *age) Set(s string) error {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return fmt.Errorf("bad age %q", s)
+		}
+		*a = age(days * float64(24*time.Hour))
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*a = age(d)
+	return nil
+}
+
+// selected reports whether the file at path, beneath roots[root],
+// passes the -include, -ext, -min-size and -older filters.
+func selected(root int, path string, info os.FileInfo) bool {
+	if info.Size() < int64(minSize) {
+		return false
+	}
+	if olderThan > 0 && time.Since(info.ModTime()) < time.Duration(olderThan) {
+		return false
+	}
+	if len(exts) > 0 {
+		ext, ok := strings.ToLower(filepath.Ext(path)), false
+		for _, e := range exts {
+			ok = ok || e == ext
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(includes) > 0 {
+		ok := false
+		for _, glob := range includes {
+			ok = ok || pattern{rootPaths[root], glob}.match(path)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// A fileSize reports the size of a file found under roots[root],
+// or, if isDir, the existence of a directory.
+type fileSize struct {
+	root      int
+	path      string
+	size      int64 // apparent size
+	allocated int64 // disk space used
+	id        fileID
+	nlink     uint64
+	isDir     bool
+}
+
+// A fileID identifies a file regardless of the names linked to it.
+// The zero fileID stands for a file whose identity the system
+// doesn't tell (see statID); such files are never taken for another.
+type fileID struct {
+	dev, ino uint64
+}
+
+// rootPaths and rootDevs hold the path and device of each root.
+var (
+	rootPaths []string
+	rootDevs  []uint64
+)
+
+// visited records the directories walked so far, so that
+// following symbolic links can't lead round in circles.
+var visited = struct {
+	sync.Mutex
+	dirs map[fileID]bool
+}{dirs: make(map[fileID]bool)}
+
+// firstVisit reports whether the directory id hasn't been walked
+// before, and marks it as walked.
+func firstVisit(id fileID) bool {
+	if id == (fileID{}) {
+		return true // can't tell; -L may go round in circles
+	}
+	visited.Lock()
+	defer visited.Unlock()
+	if visited.dirs[id] {
+		return false
+	}
+	visited.dirs[id] = true
+	return true
+}
+
+func main() {
+	flag.Parse()
+	// determine the initial directories
+	roots := flag.Args()
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	if *followLinks && *noFollow {
+		log.Fatal("du4: -L and -P are mutually exclusive")
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		log.Fatalf("du4: unknown -format %q", *format)
+	}
+	if *jobs < 1 {
+		log.Fatal("du4: -j must be at least 1")
+	}
+	sema = make(chan struct{}, *jobs)
+	var old *snapshot
+	if *diff != "" {
+		var err error
+		if old, err = loadSnapshot(*diff); err != nil {
+			log.Fatal(err)
+		}
+	}
+	rootInfos := make([]os.FileInfo, len(roots))
+	for i := range roots {
+		roots[i] = filepath.Clean(roots[i])
+		info, err := os.Stat(roots[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		rootInfos[i] = info
+		id, _, _ := statID(info)
+		rootPaths = append(rootPaths, roots[i])
+		rootDevs = append(rootDevs, id.dev)
+		firstVisit(id)
+	}
+	// Cancel the traversal on an interrupt or once -timeout has passed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Traverse the file tree
+	fileSizes := make(chan fileSize)
+
+	var wg sync.WaitGroup
+	for i, root := range roots {
+		if !rootInfos[i].IsDir() {
+			// A file named as a root is counted as it is, unfiltered.
+			id, allocated, nlink := statID(rootInfos[i])
+			wg.Add(1)
+			go func(fs fileSize) {
+				defer wg.Done()
+				fileSizes <- fs
+			}(fileSize{root: i, path: root, size: rootInfos[i].Size(), allocated: allocated, id: id, nlink: nlink})
+			continue
+		}
+		var ignores []pattern
+		for _, glob := range excludes {
+			ignores = append(ignores, pattern{root, glob})
+		}
+		wg.Add(1)
+		go walkDir(ctx, i, root, ignores, &wg, fileSizes)
+	}
+
+	go func() {
+		wg.Wait()
+		close(fileSizes)
+	}()
+
+	var tick <-chan time.Time
+	if *verbose {
+		tick = time.Tick(500 * time.Millisecond)
+	}
+	progress := os.Stdout
+	if *format != "text" {
+		progress = os.Stderr // keep the records on stdout clean
+	}
+	// Print the results
+	u := newUsage(roots, *top)
+	var incomplete string // why the traversal stopped short, if it did
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			incomplete = "interrupted"
+			if ctx.Err() == context.DeadlineExceeded {
+				incomplete = fmt.Sprintf("timed out after %s", *timeout)
+			}
+			// Restore the default signal behavior, so that a second
+			// interrupt kills a program slow to unwind.
+			stop()
+			// drain fileSizes to allow existing goroutines to finish
+			for range fileSizes {
+				// Do nothing
+			}
+		case fs, ok := <-fileSizes:
+			if !ok {
+				break loop // fileSizes was closed
+			}
+			u.add(fs)
+		case <-tick:
+			printDiskUsage(progress, u.nfiles, u.nbytes, u.nallocated)
+		}
+	}
+
+	snap := u.snapshot()
+	snap.Incomplete = incomplete != ""
+	snap.Skipped = countSkipped()
+	if *save != "" {
+		if err := snap.save(*save); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case old != nil:
+		if old.Incomplete {
+			fmt.Fprintf(os.Stderr, "du4: %s is an incomplete snapshot\n", *diff)
+		}
+		if err := writeChanges(os.Stdout, *format, changes(old, snap)); err != nil {
+			log.Fatal(err)
+		}
+	case *format != "text":
+		view := *snap
+		if *depth >= 0 {
+			view.Dirs = nil
+			for _, r := range snap.Dirs {
+				if r.Depth <= *depth {
+					view.Dirs = append(view.Dirs, r)
+				}
+			}
+		}
+		if err := writeRecords(os.Stdout, *format, &view); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if *depth >= 0 {
+			u.printTree(*depth)
+		}
+		if *top > 0 {
+			u.printTop(*top)
+		}
+		if len(roots) > 1 {
+			for _, root := range roots {
+				fmt.Printf("%10s  %s\n", formatSize(u.size(root)), root)
+			}
+		}
+		printDiskUsage(os.Stdout, u.nfiles, u.nbytes, u.nallocated)
+		if incomplete != "" {
+			fmt.Printf("INCOMPLETE: %s\n", incomplete)
+		}
+	}
+
+	status := 0
+	if reportSkipped(os.Stderr) > 0 {
+		status = 1
+	}
+	if incomplete != "" {
+		fmt.Fprintf(os.Stderr, "du4: %s; totals are incomplete\n", incomplete)
+		status = 1
+	}
+	os.Exit(status)
+}
+
+func printDiskUsage(w io.Writer, nfiles, nbytes, nallocated int64) {
+	fmt.Fprintf(w, "%d files  %.1f GB  (%.1f GB allocated)\n",
+		nfiles, float64(nbytes)/1e9, float64(nallocated)/1e9)
+}
+
+// formatSize formats n bytes in decimal units, like printDiskUsage.
+func formatSize(n int64) string {
+	const units = "kMGTPE"
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", f, units[i])
+}
+
+// usage accumulates the sizes reported by walkDir.
+// Directories and files are measured by apparent size,
+// or by allocated space with -blocks.
+type usage struct {
+	roots          []string
+	nfiles, nbytes int64
+	nallocated     int64
+	dirs           map[string]*total   // totals of the files beneath each directory
+	children       map[string][]string // subdirectories of each directory
+	files          largest             // the largest files seen so far
+	seen           map[fileID]bool     // files that may be reached by more than one path
+}
+
+func newUsage(roots []string, ntop int) *usage {
+	u := &usage{
+		roots:    roots,
+		dirs:     make(map[string]*total),
+		children: make(map[string][]string),
+		files:    largest{max: ntop},
+		seen:     make(map[fileID]bool),
+	}
+	for _, root := range roots {
+		u.dirs[root] = new(total)
+	}
+	return u
+}
+
+// A total sums up the files beneath a directory.
+type total struct {
+	files, bytes, allocated int64
+}
+
+// size returns the total size of the files beneath dir,
+// by apparent size or with -blocks by allocated space.
+func (u *usage) size(dir string) int64 {
+	if *blocks {
+		return u.dirs[dir].allocated
+	}
+	return u.dirs[dir].bytes
+}
+
+func (u *usage) add(fs fileSize) {
+	root := u.roots[fs.root]
+	if fs.isDir {
+		// Roots are already known, and might be seen twice if nested.
+		if _, ok := u.dirs[fs.path]; !ok {
+			u.dirs[fs.path] = new(total) // so that even an empty directory is listed
+			parent := filepath.Dir(fs.path)
+			u.children[parent] = append(u.children[parent], fs.path)
+		}
+		return
+	}
+	// Count a hard-linked file, or with -L a file that symbolic
+	// links might lead to, only the first time it is seen.
+	if fs.id != (fileID{}) && (fs.nlink > 1 || *followLinks) {
+		if u.seen[fs.id] {
+			return
+		}
+		u.seen[fs.id] = true
+	}
+	u.nfiles++
+	u.nbytes += fs.size
+	u.nallocated += fs.allocated
+	// Add the file to every directory from its own up to its root,
+	// or to the root alone if it is the file.
+	dir := filepath.Dir(fs.path)
+	if fs.path == root {
+		dir = root
+	}
+	for ; ; dir = filepath.Dir(dir) {
+		t := u.dirs[dir]
+		t.files++
+		t.bytes += fs.size
+		t.allocated += fs.allocated
+		if dir == root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if u.files.max > 0 {
+		if *blocks {
+			fs.size = fs.allocated
+		}
+		u.files.push(fs)
+	}
+}
+
+// printTree prints the total of each root and of its subdirectories
+// down to maxDepth levels, each indented beneath its parent.
+func (u *usage) printTree(maxDepth int) {
+	var visit func(dir, name string, depth int)
+	visit = func(dir, name string, depth int) {
+		fmt.Printf("%10s  %s%s\n", formatSize(u.size(dir)), strings.Repeat("  ", depth), name)
+		if depth == maxDepth {
+			return
+		}
+		subdirs := u.children[dir]
+		sort.Strings(subdirs)
+		for _, sub := range subdirs {
+			visit(sub, filepath.Base(sub)+string(filepath.Separator), depth+1)
+		}
+	}
+	for _, root := range u.roots {
+		visit(root, root, 0)
+	}
+}
+
+// printTop prints the n largest directories, other than the roots,
+// and the n largest files.
+func (u *usage) printTop(n int) {
+	var dirs []string
+	for dir := range u.dirs {
+		if !u.isRoot(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if si, sj := u.size(dirs[i]), u.size(dirs[j]); si != sj {
+			return si > sj
+		}
+		return dirs[i] < dirs[j]
+	})
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	fmt.Printf("largest directories:\n")
+	for _, dir := range dirs {
+		fmt.Printf("%10s  %s\n", formatSize(u.size(dir)), dir)
+	}
+	fmt.Printf("largest files:\n")
+	for _, fs := range u.files.sorted() {
+		fmt.Printf("%10s  %s\n", formatSize(fs.size), fs.path)
+	}
+}
+
+// A snapshot records the totals of each directory at some time.
+// It is what -save writes and -format json prints.
+type snapshot struct {
+	Time       time.Time   `json:"time"`
+	Incomplete bool        `json:"incomplete,omitempty"` // the traversal was cut short
+	Skipped    int         `json:"skipped,omitempty"`    // directories that couldn't be read
+	Dirs       []dirRecord `json:"dirs"`
+}
+
+type dirRecord struct {
+	Path      string `json:"path"`
+	Root      string `json:"root"`
+	Depth     int    `json:"depth"` // 0 for a root
+	Files     int64  `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	Allocated int64  `json:"allocated"`
+}
+
+// snapshot returns the totals of every directory, in path order.
+func (u *usage) snapshot() *snapshot {
+	snap := &snapshot{Time: time.Now()}
+	var visit func(root, dir string, depth int)
+	visit = func(root, dir string, depth int) {
+		t := u.dirs[dir]
+		snap.Dirs = append(snap.Dirs, dirRecord{dir, root, depth, t.files, t.bytes, t.allocated})
+		subdirs := u.children[dir]
+		sort.Strings(subdirs)
+		for _, sub := range subdirs {
+			visit(root, sub, depth+1)
+		}
+	}
+	for _, root := range u.roots {
+		visit(root, root, 0)
+	}
+	return snap
+}
+
+func (snap *snapshot) save(path string) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &snap, nil
+}
+
+func writeRecords(w io.Writer, format string, snap *snapshot) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snap)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "root", "depth", "files", "bytes", "allocated"})
+	for _, r := range snap.Dirs {
+		cw.Write([]string{r.Path, r.Root, strconv.Itoa(r.Depth),
+			strconv.FormatInt(r.Files, 10),
+			strconv.FormatInt(r.Bytes, 10),
+			strconv.FormatInt(r.Allocated, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// A change is the growth of a directory between two snapshots.
+// A directory missing from one of them counts as empty there.
+type change struct {
+	Path   string `json:"path"`
+	Status string `json:"status"` // new, gone, grew or shrank
+	Old    int64  `json:"old"`
+	New    int64  `json:"new"`
+	Delta  int64  `json:"delta"`
+}
+
+// changes returns the directories whose size differs between the
+// snapshots, largest change first.
+func changes(old, cur *snapshot) []change {
+	size := func(r dirRecord) int64 {
+		if *blocks {
+			return r.Allocated
+		}
+		return r.Bytes
+	}
+	sizes := make(map[string]*change)
+	for _, r := range old.Dirs {
+		sizes[r.Path] = &change{Path: r.Path, Status: "gone", Old: size(r)}
+	}
+	for _, r := range cur.Dirs {
+		c := sizes[r.Path]
+		if c == nil {
+			c = &change{Path: r.Path, Status: "new"}
+			sizes[r.Path] = c
+		} else if c.Status = "grew"; size(r) < c.Old {
+			c.Status = "shrank"
+		}
+		c.New = size(r)
+	}
+	var list []change
+	for _, c := range sizes {
+		if c.Delta = c.New - c.Old; c.Delta != 0 {
+			list = append(list, *c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if di, dj := abs(list[i].Delta), abs(list[j].Delta); di != dj {
+			return di > dj
+		}
+		return list[i].Path < list[j].Path
+	})
+	return list
+}
+
+func writeChanges(w io.Writer, format string, list []change) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"path", "status", "old", "new", "delta"})
+		for _, c := range list {
+			cw.Write([]string{c.Path, c.Status,
+				strconv.FormatInt(c.Old, 10),
+				strconv.FormatInt(c.New, 10),
+				strconv.FormatInt(c.Delta, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	for _, c := range list {
+		sign := "+"
+		if c.Delta < 0 {
+			sign = "-"
+		}
+		fmt.Fprintf(w, "%s%-9s %-6s %s  (%s -> %s)\n", sign, formatSize(abs(c.Delta)),
+			c.Status, c.Path, formatSize(c.Old), formatSize(c.New))
+	}
+	return nil
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (u *usage) isRoot(dir string) bool {
+	for _, root := range u.roots {
+		if dir == root {
+			return true
+		}
+	}
+	return false
+}
+
+// largest keeps the max largest files pushed onto it, as a min-heap
+// so that the smallest of them is the one to give way.
+type largest struct {
+	max   int
+	files []fileSize
+}
+
+func (h *largest) Len() int           { return len(h.files) }
+func (h *largest) Less(i, j int) bool { return h.files[i].size < h.files[j].size }
+func (h *largest) Swap(i, j int)      { h.files[i], h.files[j] = h.files[j], h.files[i] }
+func (h *largest) Push(x interface{}) { h.files = append(h.files, x.(fileSize)) }
+func (h *largest) Pop() interface{} {
+	fs := h.files[len(h.files)-1]
+	h.files = h.files[:len(h.files)-1]
+	return fs
+}
+
+func (h *largest) push(fs fileSize) {
+	if len(h.files) < h.max {
+		heap.Push(h, fs)
+	} else if fs.size > h.files[0].size {
+		h.files[0] = fs
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the files, largest first.
+func (h *largest) sorted() []fileSize {
+	files := append([]fileSize(nil), h.files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].size > files[j].size })
+	return files
+}
+
+// walkDir walks the directory dir beneath roots[root], skipping
+// whatever matches ignores or the patterns in dir/.duignore.
+func walkDir(ctx context.Context, root int, dir string, ignores []pattern, wg *sync.WaitGroup, fileSizes chan<- fileSize) {
+	defer wg.Done()
+	if ctx.Err() != nil {
+		return // cancelled
+	}
+	fileSizes <- fileSize{root: root, path: dir, isDir: true}
+	entries := dirents(ctx, dir)
+	for _, entry := range entries {
+		if entry.Name() == ".duignore" && entry.Mode().IsRegular() {
+			// Copy, as sibling directories may be adding their own.
+			ignores = append(ignores[:len(ignores):len(ignores)], readIgnoreFile(dir)...)
+		}
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if matchAny(ignores, path) {
+			continue
+		}
+		if *followLinks && entry.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "du4: %v\n", err) // probably dangling
+				continue
+			}
+			entry = target
+		}
+		id, allocated, nlink := statID(entry)
+		if entry.IsDir() {
+			if *oneFS && id.dev != rootDevs[root] {
+				continue
+			}
+			if !firstVisit(id) {
+				if *verbose {
+					fmt.Fprintf(os.Stderr, "du4: %s: directory already visited\n", path)
+				}
+				continue
+			}
+			wg.Add(1)
+			go walkDir(ctx, root, path, ignores, wg, fileSizes)
+		} else if selected(root, path, entry) {
+			fileSizes <- fileSize{
+				root:      root,
+				path:      path,
+				size:      entry.Size(),
+				allocated: allocated,
+				id:        id,
+				nlink:     nlink,
+			}
+		}
+	}
+}
+
+// sema limits the number of directories read at once to -j.
+var sema chan struct{}
+
+// dirents returns the entries of directory dir
+func dirents(ctx context.Context, dir string) []os.FileInfo {
+	select {
+	case sema <- struct{}{}: // acquire token
+	case <-ctx.Done():
+		return nil // cancelled
+	}
+	defer func() {
+		<-sema // release token
+	}()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		skip(dir, err)
+		return nil
+	}
+	return entries
+}
+
+// skipped records the directories that couldn't be read, by kind of error.
+var skipped = struct {
+	sync.Mutex
+	dirs map[string][]string
+}{dirs: make(map[string][]string)}
+
+// The kinds of error, in the order they are reported.
+var errorKinds = []string{"permission denied", "vanished", "not a directory", "I/O error"}
+
+// errorKind classifies an error from reading a directory.
+func errorKind(err error) string {
+	switch {
+	case os.IsPermission(err):
+		return "permission denied"
+	case os.IsNotExist(err):
+		return "vanished" // removed since its parent was read
+	case errors.Is(err, syscall.ENOTDIR):
+		return "not a directory" // replaced since its parent was read
+	default:
+		return "I/O error"
+	}
+}
+
+// skip records that dir couldn't be read because of err.
+func skip(dir string, err error) {
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "du4: %v\n", err)
+	}
+	kind := errorKind(err)
+	skipped.Lock()
+	skipped.dirs[kind] = append(skipped.dirs[kind], dir)
+	skipped.Unlock()
+}
+
+func countSkipped() int {
+	skipped.Lock()
+	defer skipped.Unlock()
+	n := 0
+	for _, dirs := range skipped.dirs {
+		n += len(dirs)
+	}
+	return n
+}
+
+// reportSkipped summarizes the skipped directories on w, listing the
+// first few of each kind, or all of them with -v. It returns how many
+// there were.
+func reportSkipped(w io.Writer) int {
+	const maxListed = 5
+	n := countSkipped()
+	if n == 0 {
+		return 0
+	}
+	skipped.Lock()
+	defer skipped.Unlock()
+	fmt.Fprintf(w, "du4: skipped %d unreadable directories\n", n)
+	for _, kind := range errorKinds {
+		dirs := skipped.dirs[kind]
+		if len(dirs) == 0 {
+			continue
+		}
+		sort.Strings(dirs)
+		fmt.Fprintf(w, "  %s: %d\n", kind, len(dirs))
+		for i, dir := range dirs {
+			if i == maxListed && !*verbose {
+				fmt.Fprintf(w, "    ... and %d more\n", len(dirs)-i)
+				break
+			}
+			fmt.Fprintf(w, "    %s\n", dir)
+		}
+	}
+	return n
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statID returns the identity of the file described by info, the
+// disk space it uses, and its number of links. If info doesn't come
+// from stat(2), it returns the zero fileID and the apparent size.
+func statID(info os.FileInfo) (id fileID, allocated int64, nlink uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, info.Size(), 1
+	}
+	// st_blocks is always in 512-byte units.
+	return fileID{uint64(st.Dev), uint64(st.Ino)}, st.Blocks * 512, uint64(st.Nlink)
+}
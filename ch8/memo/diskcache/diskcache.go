@@ -0,0 +1,342 @@
+// Package diskcache provides a size-limited store of byte slices on
+// disk that outlives the process, for use beneath a memo.Memo.
+//
+// Each value is kept in a file named by the SHA-256 of its contents,
+// so keys with the same value share a file. An index records which
+// file holds each key's value, together with the HTTP validators
+// needed to check later whether it is still current.
+package diskcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tao-yi/the-go-programming-language/ch8/memo"
+)
+
+// An Entry describes the value stored for a key.
+type Entry struct {
+	Sum          string    `json:"sum"` // hex SHA-256 of the value, naming its file
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"` // when the value was last known to be current
+	Used         time.Time `json:"used"`
+}
+
+// A Cache is a directory of values and the index to them.
+// It is safe for concurrent use.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex // guards index, refs, size and the files
+	index map[string]*Entry
+	refs  map[string]int // number of keys using each file, by sum
+	size  int64          // total size of the distinct files
+}
+
+// Open returns the cache in dir, creating the directory if need be
+// and loading the index left by an earlier run. Files the index
+// doesn't refer to, such as those left by a crash, are removed.
+// The files it refers to take up at most maxBytes; the least
+// recently used are removed to make room for new ones.
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    make(map[string]*Entry),
+		refs:     make(map[string]int),
+	}
+	data, err := ioutil.ReadFile(c.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if data != nil {
+		var index map[string]*Entry
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.indexPath(), err)
+		}
+		for key, e := range index {
+			// Forget entries that are damaged, or whose files have
+			// gone missing. A bad sum could name a file anywhere.
+			if e == nil || !validSum(e.Sum) {
+				continue
+			}
+			if info, err := os.Stat(c.objectPath(e.Sum)); err == nil && info.Size() == e.Size {
+				c.link(key, e)
+			}
+		}
+	}
+	if err := c.removeOrphans(); err != nil {
+		return nil, err
+	}
+	c.evict()
+	return c, nil
+}
+
+// validSum reports whether sum is a hex SHA-256 as written by Put.
+func validSum(sum string) bool {
+	if len(sum) != 2*sha256.Size {
+		return false
+	}
+	for _, r := range sum {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// removeOrphans removes the temporary files, and the files under
+// objects that no entry refers to. Open calls it before c is shared.
+func (c *Cache) removeOrphans() error {
+	tmps, err := filepath.Glob(filepath.Join(c.dir, "tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+	return filepath.Walk(filepath.Join(c.dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		sum := filepath.Base(filepath.Dir(path)) + info.Name() // see objectPath
+		if !info.IsDir() && c.refs[sum] == 0 {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.dir, "index.json")
+}
+
+func (c *Cache) objectPath(sum string) string {
+	return filepath.Join(c.dir, "objects", sum[:2], sum[2:])
+}
+
+// Get returns the entry and value stored for key, if any.
+func (c *Cache) Get(key string) (Entry, []byte, bool) {
+	c.mu.Lock()
+	e := c.index[key]
+	if e == nil {
+		c.mu.Unlock()
+		return Entry{}, nil, false
+	}
+	e.Used = time.Now()
+	entry := *e
+	c.mu.Unlock()
+
+	value, err := ioutil.ReadFile(c.objectPath(entry.Sum))
+	if err != nil {
+		// Treat a file removed behind our back as a miss.
+		c.mu.Lock()
+		if c.index[key] == e {
+			c.unlink(key)
+		}
+		c.mu.Unlock()
+		return Entry{}, nil, false
+	}
+	return entry, value, true
+}
+
+// Put stores value for key, along with the validators from the
+// response it came in. A value larger than the cache is not stored.
+func (c *Cache) Put(key string, value []byte, etag, lastModified string) error {
+	if int64(len(value)) > c.maxBytes {
+		return nil
+	}
+	sum := sha256.Sum256(value)
+	e := &Entry{
+		Sum:          hex.EncodeToString(sum[:]),
+		Size:         int64(len(value)),
+		ETag:         etag,
+		LastModified: lastModified,
+		Fetched:      time.Now(),
+		Used:         time.Now(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeObject(e.Sum, value); err != nil {
+		return err
+	}
+	// Link the new entry before unlinking the old, so that a value
+	// stored again doesn't lose the file they share.
+	old := c.index[key]
+	c.link(key, e)
+	if old != nil {
+		c.release(old)
+	}
+	c.evict()
+	return c.saveIndex()
+}
+
+// Revalidated records that the value stored for key is still current.
+func (c *Cache) Revalidated(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.index[key]; e != nil {
+		e.Fetched = time.Now()
+	}
+	return c.saveIndex()
+}
+
+// Size returns the total size of the values in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// writeObject writes value to the file named by sum, unless it is
+// already there. It writes to a temporary file first so that a crash
+// can't leave a partial value under the right name.
+// The caller must hold c.mu.
+func (c *Cache) writeObject(sum string, value []byte) error {
+	path := c.objectPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// link adds e to the index under key. The caller must hold c.mu.
+func (c *Cache) link(key string, e *Entry) {
+	c.index[key] = e
+	if c.refs[e.Sum] == 0 {
+		c.size += e.Size
+	}
+	c.refs[e.Sum]++
+}
+
+// unlink removes key from the index, and its file if no other key
+// refers to it. The caller must hold c.mu.
+func (c *Cache) unlink(key string) {
+	e := c.index[key]
+	delete(c.index, key)
+	c.release(e)
+}
+
+// release drops e's reference to its file, removing the file if
+// it was the last. The caller must hold c.mu.
+func (c *Cache) release(e *Entry) {
+	c.refs[e.Sum]--
+	if c.refs[e.Sum] == 0 {
+		delete(c.refs, e.Sum)
+		c.size -= e.Size
+		os.Remove(c.objectPath(e.Sum))
+	}
+}
+
+// evict removes the least recently used keys until the files fit
+// within c.maxBytes. The caller must hold c.mu.
+func (c *Cache) evict() {
+	if c.size <= c.maxBytes {
+		return
+	}
+	var keys []string
+	for key := range c.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.index[keys[i]].Used.Before(c.index[keys[j]].Used)
+	})
+	for _, key := range keys {
+		if c.size <= c.maxBytes {
+			break
+		}
+		c.unlink(key)
+	}
+}
+
+// saveIndex replaces the index file. The caller must hold c.mu.
+func (c *Cache) saveIndex() error {
+	data, err := json.MarshalIndent(c.index, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// HTTPGet returns a memo.Func that fetches the body of the URL it is
+// given, keeping a copy in c. A copy younger than maxAge is used as
+// is; an older one is revalidated with the server using its ETag or
+// Last-Modified time, and fetched again only if it has changed.
+func HTTPGet(c *Cache, client *http.Client, maxAge time.Duration) memo.Func {
+	return func(ctx context.Context, url string) (interface{}, error) {
+		e, body, ok := c.Get(url)
+		if ok && time.Since(e.Fetched) < maxAge {
+			return body, nil
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ok && e.ETag != "" {
+			req.Header.Set("If-None-Match", e.ETag)
+		}
+		if ok && e.LastModified != "" {
+			req.Header.Set("If-Modified-Since", e.LastModified)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotModified && ok:
+			// If the index can't be saved, the copy is still good;
+			// it will just be revalidated again sooner.
+			c.Revalidated(url)
+			return body, nil
+		case resp.StatusCode == http.StatusOK:
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			// Likewise, failing to keep a copy doesn't spoil this one.
+			c.Put(url, body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+			return body, nil
+		default:
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package diskcache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// open opens a cache in a new temporary directory.
+func open(t *testing.T, maxBytes int64) *Cache {
+	t.Helper()
+	c, err := Open(t.TempDir(), maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPutSameValueTwice(t *testing.T) {
+	c := open(t, 1<<20)
+	for i := 0; i < 2; i++ {
+		if err := c.Put("k", []byte("hello"), "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, value, ok := c.Get("k")
+	if !ok || string(value) != "hello" {
+		t.Errorf(`Get("k") = %q, %t; want "hello", true`, value, ok)
+	}
+	if got := c.Size(); got != 5 {
+		t.Errorf("Size() = %d; want 5", got)
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	c := open(t, 10)
+	c.Put("a", []byte("aaaa"), "", "")
+	c.Put("b", []byte("bbbb"), "", "")
+	c.Get("a") // b is now the least recently used
+	c.Put("c", []byte("cccc"), "", "")
+
+	for _, test := range []struct {
+		key  string
+		want bool
+	}{{"a", true}, {"b", false}, {"c", true}} {
+		if _, _, ok := c.Get(test.key); ok != test.want {
+			t.Errorf("Get(%q) found = %t; want %t", test.key, ok, test.want)
+		}
+	}
+	if got := c.Size(); got != 8 {
+		t.Errorf("Size() = %d; want 8", got)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("k", []byte("hello"), `"v1"`, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, value, ok := c.Get("k")
+	if !ok || string(value) != "hello" || e.ETag != `"v1"` {
+		t.Errorf(`after reopening, Get("k") = %q, %q, %t; want "hello", "\"v1\"", true`,
+			value, e.ETag, ok)
+	}
+}
+
+func TestOpenRemovesStrayFiles(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "cache")
+	victim := filepath.Join(base, "victim") // what a sum of "../../victim" names
+	orphan := filepath.Join(dir, "objects", "ab", "cdef")
+	tmp := filepath.Join(dir, "tmp-123")
+	for _, name := range []string{victim, orphan, tmp} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := `{
+		"empty": {"sum": "", "size": 4},
+		"escape": {"sum": "../../victim", "size": 4},
+		"null": null
+	}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Open(dir, 0) // evict everything the index holds
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Size(); got != 0 {
+		t.Errorf("Size() = %d; want 0", got)
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("file outside the cache: %v", err)
+	}
+	for _, name := range []string{orphan, tmp} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed (err = %v)", name, err)
+		}
+	}
+}
+
+// A server serves one body, answering conditional requests that
+// match its validators with 304 Not Modified.
+type server struct {
+	body, etag, lastModified string
+	fetches, notModified     int
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+	if s.lastModified != "" {
+		w.Header().Set("Last-Modified", s.lastModified)
+	}
+	if (s.etag != "" && req.Header.Get("If-None-Match") == s.etag) ||
+		(s.lastModified != "" && req.Header.Get("If-Modified-Since") == s.lastModified) {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.fetches++
+	w.Write([]byte(s.body))
+}
+
+func TestHTTPGetRevalidates(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		srv  *server
+	}{
+		{"ETag", &server{body: "hello", etag: `"v1"`}},
+		{"Last-Modified", &server{body: "hello", lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(test.srv)
+			defer ts.Close()
+			get := HTTPGet(open(t, 1<<20), ts.Client(), 0) // always revalidate
+
+			for i := 0; i < 3; i++ {
+				body, err := get(context.Background(), ts.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body.([]byte)) != "hello" {
+					t.Errorf("get #%d = %q; want \"hello\"", i, body)
+				}
+			}
+			if test.srv.fetches != 1 || test.srv.notModified != 2 {
+				t.Errorf("server saw %d fetches and %d revalidations; want 1 and 2",
+					test.srv.fetches, test.srv.notModified)
+			}
+		})
+	}
+}
+
+func TestHTTPGetFresh(t *testing.T) {
+	srv := &server{body: "hello", etag: `"v1"`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	get := HTTPGet(open(t, 1<<20), ts.Client(), time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if _, err := get(context.Background(), ts.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if srv.fetches != 1 || srv.notModified != 0 {
+		t.Errorf("server saw %d fetches and %d revalidations; want 1 and 0",
+			srv.fetches, srv.notModified)
+	}
+}
@@ -0,0 +1,129 @@
+// Package memo provides a concurrency-safe memoization of a function
+// of type Func. Concurrent requests for the same key are suppressed:
+// only the first caller computes the value, and the others wait for it.
+//
+// A cache may be bounded in size, in which case the least recently
+// used entries are evicted, and its entries may expire after a while.
+// Failed computations are not remembered unless asked for.
+//
+// There are two implementations of the Cache interface with the same
+// behavior: Memo guards its entries with a mutex, while Monitor
+// confines them to a server goroutine that its clients send requests to.
+package memo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Func is the type of the function to memoize.
+// It should give up and return an error once ctx is cancelled.
+type Func func(ctx context.Context, key string) (interface{}, error)
+
+// A Cache is a memoization of a Func.
+type Cache interface {
+	// Get returns the value of f(key), computing it only if there
+	// is no fresh entry for key.
+	//
+	// If ctx is cancelled first, Get returns ctx.Err() at once. The
+	// computation carries on for any other callers waiting for it,
+	// and is cancelled only when none remain.
+	Get(ctx context.Context, key string) (interface{}, error)
+
+	// Invalidate discards any entry for key, so the next Get recomputes it.
+	Invalidate(key string)
+
+	// Len returns the number of entries, including any that have
+	// expired but not yet been discarded.
+	Len() int
+
+	// Stats returns a snapshot of the cache's statistics.
+	Stats() Stats
+}
+
+// Options limit what a cache retains.
+type Options struct {
+	Capacity int           // maximum number of entries; 0 means no limit
+	TTL      time.Duration // how long a computed value stays fresh; 0 means forever
+
+	// RetainErrors keeps the results of failed computations like
+	// any other. By default they are discarded as soon as the
+	// callers waiting for them have been told, so the next Get retries.
+	RetainErrors bool
+}
+
+// Stats counts the outcomes of calls to Get and the entries discarded.
+type Stats struct {
+	Hits        uint64 // calls answered by an existing entry, ready or not
+	Misses      uint64 // calls that had to compute the value
+	Evictions   uint64 // entries discarded to respect Capacity
+	Expirations uint64 // entries discarded because their TTL had passed
+	Abandoned   uint64 // computations cancelled because every caller gave up
+}
+
+// A Memo is a Cache whose entries are guarded by a mutex.
+type Memo struct {
+	f  Func
+	mu sync.Mutex // guards s
+	s  *store
+}
+
+// New returns a memoization of f with no limits.
+func New(f Func) *Memo {
+	return NewWithOptions(f, Options{})
+}
+
+// NewWithOptions returns a memoization of f limited by opts.
+func NewWithOptions(f Func, opts Options) *Memo {
+	return &Memo{f: f, s: newStore(opts)}
+}
+
+func (memo *Memo) Get(ctx context.Context, key string) (interface{}, error) {
+	memo.mu.Lock()
+	e, cctx := memo.s.get(key)
+	memo.mu.Unlock()
+	if cctx != nil {
+		// This is the first request for this key
+		// A new goroutine becomes responsible for computing
+		// the value and broadcasting the ready condition
+		go memo.compute(cctx, e)
+	}
+
+	select {
+	case <-e.ready: // wait for ready condition
+		return e.res.value, e.res.err
+	case <-ctx.Done():
+		memo.mu.Lock()
+		memo.s.abandon(e)
+		memo.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (memo *Memo) compute(ctx context.Context, e *entry) {
+	var res result
+	res.value, res.err = memo.f(ctx, e.key)
+	memo.mu.Lock()
+	memo.s.finish(e, res)
+	memo.mu.Unlock()
+	close(e.ready)
+}
+
+func (memo *Memo) Invalidate(key string) {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	memo.s.invalidate(key)
+}
+
+func (memo *Memo) Len() int {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	return len(memo.s.cache)
+}
+
+func (memo *Memo) Stats() Stats {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	return memo.s.stats
+}
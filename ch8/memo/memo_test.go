@@ -0,0 +1,375 @@
+package memo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tao-yi/the-go-programming-language/ch8/memo"
+)
+
+// An implementation makes a memo.Cache and later releases it.
+type implementation struct {
+	name string
+	new  func(f memo.Func, opts memo.Options) (memo.Cache, func())
+}
+
+var implementations = []implementation{
+	{"mutex", func(f memo.Func, opts memo.Options) (memo.Cache, func()) {
+		return memo.NewWithOptions(f, opts), func() {}
+	}},
+	{"monitor", func(f memo.Func, opts memo.Options) (memo.Cache, func()) {
+		m := memo.NewMonitor(f, opts)
+		return m, m.Close
+	}},
+}
+
+// A scenario is a pattern of keys to request and the limits to impose.
+type scenario struct {
+	name string
+	keys int
+	opts memo.Options
+}
+
+var scenarios = []scenario{
+	{"onekey", 1, memo.Options{}},
+	{"1000keys", 1000, memo.Options{}},
+	{"1000keys-cap100", 1000, memo.Options{Capacity: 100}},
+	{"1000keys-ttl1ms", 1000, memo.Options{TTL: time.Millisecond}},
+}
+
+// BenchmarkGet measures Get on a cache of a cheap function, requesting
+// random keys from 1, 8 and 64 goroutines per CPU.
+func BenchmarkGet(b *testing.B) {
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			for _, sc := range scenarios {
+				b.Run(sc.name, func(b *testing.B) {
+					for _, parallelism := range []int{1, 8, 64} {
+						b.Run(fmt.Sprintf("p%d", parallelism), func(b *testing.B) {
+							benchmarkGet(b, impl, sc, parallelism)
+						})
+					}
+				})
+			}
+		})
+	}
+}
+
+func benchmarkGet(b *testing.B, impl implementation, sc scenario, parallelism int) {
+	keys := make([]string, sc.keys)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	f := func(ctx context.Context, key string) (interface{}, error) {
+		return len(key), nil
+	}
+	c, release := impl.new(f, sc.opts)
+	defer release()
+	b.ReportAllocs()
+	b.SetParallelism(parallelism)
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		ctx := context.Background()
+		for pb.Next() {
+			if _, err := c.Get(ctx, keys[rng.Intn(len(keys))]); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+var errUnlucky = errors.New("unlucky key")
+
+// TestStress hammers each implementation with a random mix of
+// operations and checks their answers. Run it under the race
+// detector to look for data races:
+//
+//	go test -race -run Stress
+func TestStress(t *testing.T) {
+	duration := 2 * time.Second
+	if testing.Short() {
+		duration = 200 * time.Millisecond
+	}
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			stress(t, impl, duration)
+		})
+	}
+}
+
+func stress(t *testing.T, impl implementation, duration time.Duration) {
+	const capacity = 50
+	f := func(ctx context.Context, key string) (interface{}, error) {
+		select {
+		case <-time.After(time.Duration(rand.Intn(200)) * time.Microsecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		n, _ := strconv.Atoi(key)
+		if n%7 == 0 {
+			return nil, errUnlucky // sometimes fails, to exercise the retry path
+		}
+		return n * n, nil
+	}
+	c, release := impl.new(f, memo.Options{Capacity: capacity, TTL: 5 * time.Millisecond})
+	defer release()
+
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				n := rng.Intn(2 * capacity)
+				key := strconv.Itoa(n)
+				switch op := rng.Intn(10); {
+				case op < 6:
+					v, err := c.Get(context.Background(), key)
+					switch {
+					case n%7 == 0 && err != errUnlucky:
+						t.Errorf("Get(%s) = %v, %v; want error %v", key, v, err, errUnlucky)
+					case n%7 != 0 && (err != nil || v != n*n):
+						t.Errorf("Get(%s) = %v, %v; want %d", key, v, err, n*n)
+					}
+				case op < 8:
+					// an impatient caller
+					ctx, cancel := context.WithTimeout(context.Background(),
+						time.Duration(rng.Intn(100))*time.Microsecond)
+					v, err := c.Get(ctx, key)
+					cancel()
+					if err == nil && v != n*n {
+						t.Errorf("Get(%s) = %v; want %d", key, v, n*n)
+					}
+				case op < 9:
+					c.Invalidate(key)
+				default:
+					if l := c.Len(); l > capacity {
+						t.Errorf("Len() = %d; want at most %d", l, capacity)
+					}
+					c.Stats()
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	t.Logf("%+v", c.Stats())
+}
+
+// A counter is a Func that returns the length of its key,
+// counting how often it is called for each key.
+type counter struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *counter) f(ctx context.Context, key string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[key]++
+	return len(key), nil
+}
+
+func (c *counter) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[key]
+}
+
+// getAll calls Get for each key in turn, failing t on a wrong value.
+func getAll(t *testing.T, c memo.Cache, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if v, err := c.Get(context.Background(), key); err != nil || v != len(key) {
+			t.Fatalf("Get(%q) = %v, %v; want %d", key, v, err, len(key))
+		}
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			var cnt counter
+			c, release := impl.new(cnt.f, memo.Options{Capacity: 2})
+			defer release()
+
+			getAll(t, c, "a", "bb", "a", "ccc") // "bb" is the least recently used
+			getAll(t, c, "bb")                  // evicts "a"
+			getAll(t, c, "ccc")
+
+			for key, want := range map[string]int{"a": 1, "bb": 2, "ccc": 1} {
+				if got := cnt.count(key); got != want {
+					t.Errorf("%q computed %d times; want %d", key, got, want)
+				}
+			}
+			if got := c.Len(); got != 2 {
+				t.Errorf("Len() = %d; want 2", got)
+			}
+			want := memo.Stats{Hits: 2, Misses: 4, Evictions: 2}
+			if got := c.Stats(); got != want {
+				t.Errorf("Stats() = %+v; want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			for _, test := range []struct {
+				ttl       time.Duration
+				wantCalls int
+				want      memo.Stats
+			}{
+				{time.Hour, 1, memo.Stats{Hits: 2, Misses: 1}},
+				// A value that is stale as soon as it is made.
+				{time.Nanosecond, 3, memo.Stats{Misses: 3, Expirations: 2}},
+			} {
+				var cnt counter
+				c, release := impl.new(cnt.f, memo.Options{TTL: test.ttl})
+				getAll(t, c, "a", "a", "a")
+				if got := cnt.count("a"); got != test.wantCalls {
+					t.Errorf("TTL %s: computed %d times; want %d", test.ttl, got, test.wantCalls)
+				}
+				if got := c.Stats(); got != test.want {
+					t.Errorf("TTL %s: Stats() = %+v; want %+v", test.ttl, got, test.want)
+				}
+				release()
+			}
+		})
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name, func(t *testing.T) {
+			var cnt counter
+			c, release := impl.new(cnt.f, memo.Options{})
+			defer release()
+
+			getAll(t, c, "a", "bb")
+			c.Invalidate("a")
+			c.Invalidate("zzz") // not there; a no-op
+			if got := c.Len(); got != 1 {
+				t.Errorf("Len() after Invalidate = %d; want 1", got)
+			}
+			getAll(t, c, "a", "bb")
+
+			if got := cnt.count("a"); got != 2 {
+				t.Errorf(`"a" computed %d times; want 2`, got)
+			}
+			if got := cnt.count("bb"); got != 1 {
+				t.Errorf(`"bb" computed %d times; want 1`, got)
+			}
+			want := memo.Stats{Hits: 1, Misses: 3}
+			if got := c.Stats(); got != want {
+				t.Errorf("Stats() = %+v; want %+v", got, want)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing t after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestWaitersAndErrors checks that a computation carries on until the
+// last caller waiting for it gives up, and that a failure is computed
+// again on the next Get unless Options.RetainErrors is set.
+func TestWaitersAndErrors(t *testing.T) {
+	for _, impl := range implementations {
+		t.Run(impl.name+"/abandon", func(t *testing.T) {
+			started := make(chan context.Context)
+			f := func(ctx context.Context, key string) (interface{}, error) {
+				started <- ctx
+				<-ctx.Done() // never finishes unless cancelled
+				return nil, ctx.Err()
+			}
+			c, release := impl.new(f, memo.Options{})
+			defer release()
+
+			cancels := make([]context.CancelFunc, 3)
+			errs := make(chan error)
+			for i := range cancels {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				go func() {
+					_, err := c.Get(ctx, "k")
+					errs <- err
+				}()
+			}
+			computing := <-started
+			waitFor(t, "every caller to wait", func() bool {
+				s := c.Stats()
+				return s.Hits+s.Misses == uint64(len(cancels))
+			})
+
+			for i, cancel := range cancels {
+				cancel()
+				if err := <-errs; err != context.Canceled {
+					t.Errorf("Get = %v; want %v", err, context.Canceled)
+				}
+				if i == len(cancels)-1 {
+					break
+				}
+				// Stats waits for c to take in that the caller gave up.
+				if got := c.Stats().Abandoned; got != 0 {
+					t.Errorf("with %d callers left, Stats().Abandoned = %d; want 0", len(cancels)-1-i, got)
+				}
+				if computing.Err() != nil {
+					t.Fatalf("computation cancelled with %d callers left", len(cancels)-1-i)
+				}
+			}
+			select {
+			case <-computing.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("computation not cancelled when the last caller gave up")
+			}
+			if got := c.Stats().Abandoned; got != 1 {
+				t.Errorf("Stats().Abandoned = %d; want 1", got)
+			}
+		})
+
+		for _, retain := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/RetainErrors=%t", impl.name, retain), func(t *testing.T) {
+				calls := 0
+				f := func(ctx context.Context, key string) (interface{}, error) {
+					calls++ // Get waits for the computation, so calls don't overlap
+					if calls == 1 {
+						return nil, errUnlucky
+					}
+					return calls, nil
+				}
+				c, release := impl.new(f, memo.Options{RetainErrors: retain})
+				defer release()
+
+				if _, err := c.Get(context.Background(), "k"); err != errUnlucky {
+					t.Fatalf("first Get = %v; want %v", err, errUnlucky)
+				}
+				v, err := c.Get(context.Background(), "k")
+				switch {
+				case retain && (err != errUnlucky || calls != 1):
+					t.Errorf("second Get = %v, %v after %d calls; want %v after 1", v, err, calls, errUnlucky)
+				case !retain && (err != nil || v != 2):
+					t.Errorf("second Get = %v, %v; want 2, <nil>", v, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package memo
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned by a Monitor's Get once it has been closed.
+var ErrClosed = errors.New("memo: monitor closed")
+
+// A getRequest is a message requesting the entry for key.
+type getRequest struct {
+	key      string
+	response chan<- *entry // the server sends the entry here
+}
+
+// A delivery carries the result of computing an entry to the server.
+type delivery struct {
+	e   *entry
+	res result
+}
+
+// A Monitor is a Cache whose entries are confined to a monitor
+// goroutine, which its methods communicate with over channels.
+// Close stops the monitor goroutine.
+type Monitor struct {
+	f             Func
+	requests      chan getRequest
+	abandons      chan *entry
+	deliveries    chan delivery
+	invalidations chan string
+	lens          chan chan<- int
+	stats         chan chan<- Stats
+	quit          chan struct{}
+}
+
+// NewMonitor returns a memoization of f limited by opts.
+func NewMonitor(f Func, opts Options) *Monitor {
+	m := &Monitor{
+		f:             f,
+		requests:      make(chan getRequest),
+		abandons:      make(chan *entry),
+		deliveries:    make(chan delivery),
+		invalidations: make(chan string),
+		lens:          make(chan chan<- int),
+		stats:         make(chan chan<- Stats),
+		quit:          make(chan struct{}),
+	}
+	go m.server(newStore(opts))
+	return m
+}
+
+func (m *Monitor) Get(ctx context.Context, key string) (interface{}, error) {
+	response := make(chan *entry, 1)
+	select {
+	case m.requests <- getRequest{key, response}:
+	case <-m.quit:
+		return nil, ErrClosed
+	}
+	e := <-response
+
+	select {
+	case <-e.ready: // wait for ready condition
+		return e.res.value, e.res.err
+	case <-ctx.Done():
+		select {
+		case m.abandons <- e:
+		case <-m.quit:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (m *Monitor) Invalidate(key string) {
+	select {
+	case m.invalidations <- key:
+	case <-m.quit:
+	}
+}
+
+// Len returns the number of entries, or 0 once m is closed.
+func (m *Monitor) Len() int {
+	reply := make(chan int, 1)
+	select {
+	case m.lens <- reply:
+		return <-reply
+	case <-m.quit:
+		return 0
+	}
+}
+
+// Stats returns a snapshot of m's statistics, or zero once m is closed.
+func (m *Monitor) Stats() Stats {
+	reply := make(chan Stats, 1)
+	select {
+	case m.stats <- reply:
+		return <-reply
+	case <-m.quit:
+		return Stats{}
+	}
+}
+
+// Close stops the monitor goroutine. Computations in progress are
+// cancelled and their callers get ErrClosed, as do later calls to Get.
+// Close must be called only once.
+func (m *Monitor) Close() {
+	close(m.quit)
+}
+
+func (m *Monitor) server(s *store) {
+	pending := make(map[*entry]bool) // entries being computed, evicted or not
+	for {
+		select {
+		case req := <-m.requests:
+			e, ctx := s.get(req.key)
+			if ctx != nil {
+				// This is the first request for this key
+				pending[e] = true
+				go m.compute(ctx, e)
+			}
+			req.response <- e
+		case e := <-m.abandons:
+			s.abandon(e)
+		case d := <-m.deliveries:
+			delete(pending, d.e)
+			s.finish(d.e, d.res)
+			close(d.e.ready) // broadcast the ready condition
+		case key := <-m.invalidations:
+			s.invalidate(key)
+		case reply := <-m.lens:
+			reply <- len(s.cache)
+		case reply := <-m.stats:
+			reply <- s.stats
+		case <-m.quit:
+			for e := range pending {
+				s.finish(e, result{nil, ErrClosed})
+				close(e.ready)
+			}
+			return
+		}
+	}
+}
+
+func (m *Monitor) compute(ctx context.Context, e *entry) {
+	var res result
+	res.value, res.err = m.f(ctx, e.key)
+	select {
+	case m.deliveries <- delivery{e, res}:
+	case <-m.quit: // the server has given e its result
+	}
+}
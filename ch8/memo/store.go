@@ -0,0 +1,134 @@
+package memo
+
+import (
+	"container/list"
+	"context"
+	"time"
+)
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+type entry struct {
+	key   string
+	res   result
+	ready chan struct{} // closed when res is ready
+
+	// The remaining fields belong to the store.
+	computed bool          // res is ready
+	expires  time.Time     // zero if never
+	elem     *list.Element // position in store.lru
+
+	// The computation is cancelled if every caller waiting
+	// for it gives up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// A store holds the entries of a memo and enforces its Options.
+// It is not concurrency-safe: a Memo guards it with a mutex,
+// and a Monitor confines it to a single goroutine.
+type store struct {
+	opts  Options
+	cache map[string]*entry
+	lru   *list.List // of *entry, most recently used first
+	stats Stats
+}
+
+func newStore(opts Options) *store {
+	return &store{
+		opts:  opts,
+		cache: make(map[string]*entry),
+		lru:   list.New(),
+	}
+}
+
+// get returns the entry for key and counts the caller among its
+// waiters. If the entry is new, get also returns the context in
+// which the caller must compute its value and then call finish.
+func (s *store) get(key string) (*entry, context.Context) {
+	var ctx context.Context
+	e := s.lookup(key)
+	if e == nil {
+		s.stats.Misses++
+		e = s.add(key)
+		// The computation doesn't use the caller's context,
+		// which belongs to that caller alone.
+		ctx, e.cancel = context.WithCancel(context.Background())
+	} else {
+		s.stats.Hits++
+	}
+	e.waiters++
+	return e, ctx
+}
+
+// finish records the result of e's computation. The caller must
+// then broadcast the ready condition by closing e.ready.
+func (s *store) finish(e *entry, res result) {
+	e.res = res
+	e.computed = true
+	e.cancel() // release the context's resources
+	if res.err != nil && !s.opts.RetainErrors {
+		s.remove(e) // those already waiting still get the error
+	} else if s.opts.TTL > 0 {
+		e.expires = time.Now().Add(s.opts.TTL)
+	}
+}
+
+// abandon records that one of e's waiters has given up, cancelling
+// the computation if it was the last.
+func (s *store) abandon(e *entry) {
+	e.waiters--
+	if e.waiters == 0 && !e.computed {
+		e.cancel()
+		s.remove(e) // so the next caller starts afresh
+		s.stats.Abandoned++
+	}
+}
+
+// lookup returns the entry for key, marking it as recently used,
+// or nil if there is none or it has expired.
+func (s *store) lookup(key string) *entry {
+	e := s.cache[key]
+	if e == nil {
+		return nil
+	}
+	if e.computed && !e.expires.IsZero() && time.Now().After(e.expires) {
+		s.remove(e)
+		s.stats.Expirations++
+		return nil
+	}
+	s.lru.MoveToFront(e.elem)
+	return e
+}
+
+// add makes a new entry for key, evicting the least recently
+// used entry if the store is full.
+func (s *store) add(key string) *entry {
+	if s.opts.Capacity > 0 && s.lru.Len() >= s.opts.Capacity {
+		s.remove(s.lru.Back().Value.(*entry))
+		s.stats.Evictions++
+	}
+	e := &entry{key: key, ready: make(chan struct{})}
+	e.elem = s.lru.PushFront(e)
+	s.cache[key] = e
+	return e
+}
+
+// remove discards e, if it hasn't been already.
+// Callers already waiting on it still get its value.
+func (s *store) remove(e *entry) {
+	if s.cache[e.key] != e {
+		return
+	}
+	s.lru.Remove(e.elem)
+	delete(s.cache, e.key)
+}
+
+func (s *store) invalidate(key string) {
+	if e := s.cache[key]; e != nil {
+		s.remove(e)
+	}
+}
@@ -1,61 +1,31 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"sync"
 	"time"
-)
-
-type entry struct {
-	res   result
-	ready chan struct{} // closed when res is ready
-}
-
-type Memo struct {
-	f     Func
-	mu    sync.Mutex // guards cache from race condition
-	cache map[string]*entry
-}
-
-// Func is the type of the function to memoize
-type Func func(key string) (interface{}, error)
 
-type result struct {
-	value interface{}
-	err   error
-}
+	"github.com/tao-yi/the-go-programming-language/ch8/memo"
+	"github.com/tao-yi/the-go-programming-language/ch8/memo/diskcache"
+)
 
-func New(f Func) *Memo {
-	return &Memo{f: f, cache: make(map[string]*entry)}
-}
+var (
+	cacheDir  = flag.String("cache", "", "directory in which to keep fetched bodies between runs")
+	cacheSize = flag.Int64("cache-size", 100<<20, "maximum total size in bytes of the bodies kept in -cache")
+	maxAge    = flag.Duration("max-age", time.Hour, "how long a kept body is used before revalidating it")
+)
 
-// NOTE: not concurrency-safe!
-func (memo *Memo) Get(key string) (interface{}, error) {
-	memo.mu.Lock()
-	e := memo.cache[key]
-	if e == nil {
-		// This is the first request for this key
-		// This goroutine becomes responsible for computing
-		// the value and broadcasting the ready condition
-		e = &entry{ready: make(chan struct{})}
-		memo.cache[key] = e
-		memo.mu.Unlock()
-		e.res.value, e.res.err = memo.f(key)
-		close(e.ready)
-	} else {
-		// this is a repeat request for this key
-		memo.mu.Unlock()
-		<-e.ready // wait for ready condition
+func httpGetbody(ctx context.Context, url string) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	return e.res.value, e.res.err
-}
-
-func httpGetbody(url string) (interface{}, error) {
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -64,21 +34,34 @@ func httpGetbody(url string) (interface{}, error) {
 }
 
 func main() {
-	m := New(httpGetbody)
+	flag.Parse()
+	get := memo.Func(httpGetbody)
+	if *cacheDir != "" {
+		c, err := diskcache.Open(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		get = diskcache.HTTPGet(c, http.DefaultClient, *maxAge)
+	}
+	m := memo.New(get)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	var n sync.WaitGroup
 	for _, url := range incomingURLs() {
 		n.Add(1)
 		go func(url string) {
 			defer n.Done()
 			start := time.Now()
-			value, err := m.Get(url)
+			value, err := m.Get(ctx, url)
 			if err != nil {
 				log.Println(err)
+				return
 			}
 			fmt.Printf("%s, %s, %d bytes\n", url, time.Since(start), len(value.([]byte)))
 		}(url)
 	}
 	n.Wait()
+	fmt.Printf("%+v\n", m.Stats())
 }
 
 var incomingURLsOnce sync.Once
@@ -1,36 +1,568 @@
+// Thumbnail makes a thumbnail of each JPEG, PNG or GIF image it is
+// given, writing foo.thumb.jpg next to foo.png. Its arguments are image
+// files or directories of them; with none, it reads file names from
+// the standard input, one per line.
+//
+// A manifest, .thumbnails.json, in each directory records what its
+// thumbnails were made from, so that later runs skip the images that
+// haven't changed (unless -force) and remove the thumbnails of those
+// that have gone.
+//
+//	$ thumbnail -width 200 -height 150 photos
+//	$ find photos -name '*.png' | thumbnail
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"image"
+	_ "image/gif" // register GIF decoder
+	"image/jpeg"
+	_ "image/png" // register PNG decoder
+	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
-	"time"
+	"syscall"
+)
+
+var (
+	width     = flag.Int("width", 128, "fit thumbnails within a box `N` pixels wide")
+	height    = flag.Int("height", 128, "fit thumbnails within a box `N` pixels high")
+	workers   = flag.Int("j", runtime.NumCPU(), "make at most `N` thumbnails at once")
+	keepGoing = flag.Bool("k", false, "keep going after a failure and report every error at the end")
+	quiet     = flag.Bool("q", false, "don't report progress for each file")
+	force     = flag.Bool("force", false, "remake thumbnails even if they are up to date")
 )
 
 func main() {
-	filenames := []string{
-		"a.jpeg",
-		"b.jpeg",
-		"c.jpeg",
-		"d.jpeg",
+	flag.Parse()
+	if *width < 1 || *height < 1 {
+		log.Fatal("thumbnail: -width and -height must be positive")
+	}
+	if *workers < 1 {
+		log.Fatal("thumbnail: -j must be at least 1")
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// makeThumbnails3(filenames)
-	// makeThumbnails4(filenames)
-	fs, _ := makeThumbnails5(filenames)
-	for _, f := range fs {
-		fmt.Println(f)
+	// List the directories up front, so that a bad argument is
+	// reported before any work starts.
+	var names []string
+	failed := false
+	cache := newManifests()
+	for _, arg := range flag.Args() {
+		list, err := images(arg)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		names = append(names, list...)
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			cache.load(arg) // so its stale thumbnails are found
+		}
+	}
+
+	// done is cancelled once the pool has returned, perhaps having
+	// stopped early, so that the sender doesn't wait on it forever.
+	done, cancel := context.WithCancel(ctx)
+	defer cancel()
+	filenames := make(chan string)
+	go func() {
+		defer close(filenames)
+		send := func(name string) bool {
+			select {
+			case filenames <- name:
+				return true
+			case <-done.Done():
+				return false // interrupted, or the pool has stopped
+			}
+		}
+		if flag.NArg() > 0 {
+			for _, name := range names {
+				if !send(name) {
+					return
+				}
+			}
+			return
+		}
+		input := bufio.NewScanner(os.Stdin)
+		for input.Scan() {
+			name := strings.TrimSpace(input.Text())
+			if name == "" || isThumb(name) {
+				continue // e.g., a listing of a directory already done
+			}
+			if !send(name) {
+				return
+			}
+		}
+		if err := input.Err(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	p := &pool{workers: *workers, keepGoing: *keepGoing, cache: cache, force: *force}
+	n := 0
+	p.progress = func(r result) {
+		n++
+		switch {
+		case r.err != nil:
+			fmt.Fprintf(os.Stderr, "%4d  %v\n", n, r.err)
+		case *quiet:
+		case r.upToDate:
+			fmt.Fprintf(os.Stderr, "%4d  %s (up to date)\n", n, r.thumbfile)
+		default:
+			fmt.Fprintf(os.Stderr, "%4d  %s (%d bytes)\n", n, r.thumbfile, r.size)
+		}
+	}
+	total, err := p.run(ctx, filenames)
+	cancel()
+	stop() // a second interrupt now kills the cleanup below
+	fmt.Printf("%d bytes of thumbnails\n", total)
+	for _, thumb := range cache.prune() {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "      removed %s\n", thumb)
+		}
+	}
+	if err := cache.save(); err != nil {
+		log.Print(err)
+		failed = true
+	}
+	if err != nil {
+		// The failures themselves have been reported as progress.
+		if list, ok := err.(errorList); ok && len(list) > 1 {
+			log.Printf("thumbnail: %d files failed", len(list))
+		} else if err == context.Canceled {
+			log.Print("thumbnail: interrupted")
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
 	}
 }
 
+// A pool makes thumbnails using a fixed number of worker goroutines.
+type pool struct {
+	workers   int  // at most this many thumbnails are made at once
+	keepGoing bool // carry on after a failure instead of cancelling the rest
+
+	// If cache is not nil, a file whose thumbnail it records as made
+	// from the same contents with the same -width and -height is not
+	// made again, unless force.
+	cache *manifests
+	force bool
+
+	// progress, if not nil, is called with the result for each file
+	// as it finishes. Calls are made from one goroutine at a time.
+	progress func(result)
+}
+
+// A result is the outcome of making the thumbnail of one file.
+type result struct {
+	infile    string
+	thumbfile string
+	size      int64 // of thumbfile
+	upToDate  bool  // thumbfile was already made, and not made again
+	err       error
+}
+
+// run makes thumbnails of the files received from filenames until it
+// is closed, and returns the total size of the thumbnails. Unless
+// p.keepGoing, the first failure cancels the outstanding work and is
+// returned as is; otherwise every failure is returned, in an errorList.
+// Cancelling ctx likewise stops the work and returns ctx.Err().
+// Files already being scaled are finished either way. Having stopped,
+// run receives no more from filenames, so the sender must give up
+// once run has returned.
+func (p *pool) run(ctx context.Context, filenames <-chan string) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		// worker
+		go func() {
+			defer wg.Done()
+			for {
+				var f string
+				select {
+				case name, ok := <-filenames:
+					if !ok {
+						return
+					}
+					f = name
+				case <-ctx.Done():
+					return
+				}
+				if ctx.Err() != nil {
+					return // cancelled while f was on its way
+				}
+				select {
+				case results <- p.thumbnail(f):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// closer
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var total int64
+	var errs errorList
+	for r := range results {
+		if p.progress != nil {
+			p.progress(r)
+		}
+		if r.err != nil {
+			errs = append(errs, r.err)
+			if !p.keepGoing {
+				cancel()
+			}
+			continue
+		}
+		total += r.size
+	}
+
+	switch {
+	case len(errs) > 0 && !p.keepGoing:
+		return total, errs[0]
+	case len(errs) > 0:
+		return total, errs
+	default:
+		return total, ctx.Err() // nil unless the caller cancelled
+	}
+}
+
+// thumbnail makes the thumbnail of infile, if it is out of date.
+func (p *pool) thumbnail(infile string) result {
+	r := result{infile: infile}
+	var want thumbEntry
+	if p.cache != nil {
+		sum, err := hashFile(infile)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		want = thumbEntry{Sum: sum, Width: *width, Height: *height}
+		if have, ok := p.cache.lookup(infile); ok && have == want && !p.force {
+			r.thumbfile = thumbName(infile)
+			if info, err := os.Stat(r.thumbfile); err == nil {
+				r.size = info.Size()
+				r.upToDate = true
+				return r
+			}
+			// The thumbnail has been removed since; make it again.
+		}
+	}
+
+	r.thumbfile, r.err = ImageFile(infile)
+	if r.err == nil {
+		var info os.FileInfo
+		if info, r.err = os.Stat(r.thumbfile); r.err == nil {
+			r.size = info.Size()
+		}
+	}
+	// On failure the old thumbnail, if any, is still in place, and so is
+	// the entry describing it; the changed sum makes the next run retry.
+	if p.cache != nil && r.err == nil {
+		p.cache.record(infile, want)
+	}
+	return r
+}
+
+// An errorList is the failures of a pool run in -k mode.
+type errorList []error
+
+func (l errorList) Error() string {
+	if len(l) == 1 {
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%d files failed; first: %v", len(l), l[0])
+}
+
+// images returns path if it is a file, or the image files in it if
+// it is a directory, leaving out thumbnails made earlier.
+func images(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || isThumb(name) {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".jpg", ".jpeg", ".png", ".gif":
+			names = append(names, filepath.Join(path, name))
+		}
+	}
+	return names, nil
+}
+
+// isThumb reports whether name is a thumbnail made by ImageFile.
+func isThumb(name string) bool {
+	return strings.HasSuffix(name, ".thumb.jpg")
+}
+
 // ImageFile reads an image from infile and writes
-// a thumbnail-size version of it in the same directoty
-// It returns the generated file name, e.g., "foo.thumb.jpg"
+// a thumbnail-size version of it in the same directory.
+// It returns the generated file name, e.g., "foo.thumb.jpg".
 func ImageFile(infile string) (string, error) {
-	time.Sleep(time.Duration(rand.Intn(3)) * time.Second)
-	return infile, nil
+	outfile := thumbName(infile)
+	return outfile, ImageFile2(outfile, infile)
+}
+
+// thumbName returns the name of the thumbnail of infile.
+func thumbName(infile string) string {
+	ext := filepath.Ext(infile) // e.g., ".jpg", ".JPEG"
+	return strings.TrimSuffix(infile, ext) + ".thumb.jpg"
+}
+
+// ImageFile2 reads an image from infile and writes
+// a thumbnail-size version of it to outfile.
+func ImageFile2(outfile, infile string) error {
+	in, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Write to a temporary file and rename it, so that a failure
+	// or a concurrent write of the same thumbnail (foo.jpg and foo.png
+	// share one) never leaves a partial file under outfile.
+	out, err := ioutil.TempFile(filepath.Dir(outfile), ".thumb-")
+	if err != nil {
+		return err
+	}
+	if err := ImageStream(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return fmt.Errorf("scaling %s: %v", infile, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), outfile)
+}
+
+// ImageStream reads an image from r and
+// writes a thumbnail-size version of it to w.
+func ImageStream(w io.Writer, r io.Reader) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+	dst := Image(src, *width, *height)
+	return jpeg.Encode(w, dst, nil)
+}
+
+// Image returns a copy of src scaled down to fit within a box of
+// the given width and height, keeping its aspect ratio. An image
+// that already fits is copied unscaled. Each pixel of the result is
+// the average of the pixels of src that it covers.
+// Transparent areas come out white.
+func Image(src image.Image, width, height int) image.Image {
+	sb := src.Bounds()
+	xs, ys := sb.Dx(), sb.Dy()
+	if xs <= width && ys <= height {
+		width, height = xs, ys
+	} else if xs*height > ys*width {
+		height = ys * width / xs // landscape
+	} else {
+		width = xs * height / ys // portrait
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := sb.Min.Y+y*ys/height, sb.Min.Y+(y+1)*ys/height
+		for x := 0; x < width; x++ {
+			x0, x1 := sb.Min.X+x*xs/width, sb.Min.X+(x+1)*xs/width
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// JPEG has no alpha channel, so lay the
+			// (premultiplied) colors over a white background.
+			bg := 0xffff - a/n
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((r/n + bg) >> 8)
+			dst.Pix[i+1] = uint8((g/n + bg) >> 8)
+			dst.Pix[i+2] = uint8((b/n + bg) >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// A thumbEntry records what a thumbnail was made from.
+type thumbEntry struct {
+	Sum    string `json:"sum"` // hex SHA-256 of the source file
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// manifestName is the file in each directory that records the
+// thumbnails made there, by source file name.
+const manifestName = ".thumbnails.json"
+
+// manifests holds the manifests of the directories seen so far.
+// It is safe for concurrent use.
+type manifests struct {
+	mu    sync.Mutex
+	dirs  map[string]map[string]thumbEntry // by directory, then source name
+	dirty map[string]bool                  // directories whose manifest has changed
+}
+
+func newManifests() *manifests {
+	return &manifests{
+		dirs:  make(map[string]map[string]thumbEntry),
+		dirty: make(map[string]bool),
+	}
+}
+
+// load returns the manifest of dir, reading it if need be.
+// A missing or unreadable manifest is treated as empty, which
+// just means its thumbnails get made again.
+func (m *manifests) load(dir string) map[string]thumbEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loadLocked(filepath.Clean(dir))
+}
+
+func (m *manifests) loadLocked(dir string) map[string]thumbEntry {
+	entries := m.dirs[dir]
+	if entries == nil {
+		entries = make(map[string]thumbEntry)
+		if data, err := ioutil.ReadFile(filepath.Join(dir, manifestName)); err == nil {
+			if err := json.Unmarshal(data, &entries); err != nil {
+				log.Printf("thumbnail: ignoring %s: %v", filepath.Join(dir, manifestName), err)
+				entries = make(map[string]thumbEntry)
+			}
+		}
+		m.dirs[dir] = entries
+	}
+	return entries
+}
+
+func (m *manifests) lookup(infile string) (thumbEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.loadLocked(filepath.Dir(infile))[filepath.Base(infile)]
+	return e, ok
+}
+
+func (m *manifests) record(infile string, e thumbEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := filepath.Dir(infile)
+	m.loadLocked(dir)[filepath.Base(infile)] = e
+	m.dirty[dir] = true
+}
+
+// prune forgets the sources that no longer exist, removing their
+// thumbnails unless another source (foo.png for foo.jpg) shares them.
+// It returns the names of the thumbnails removed.
+func (m *manifests) prune() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed []string
+	for dir, entries := range m.dirs {
+		var stale []string
+		for name := range entries {
+			if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+				delete(entries, name)
+				stale = append(stale, thumbName(name))
+				m.dirty[dir] = true
+			}
+		}
+		shared := make(map[string]bool)
+		for name := range entries {
+			shared[thumbName(name)] = true
+		}
+		for _, thumb := range stale {
+			path := filepath.Join(dir, thumb)
+			if !shared[thumb] && os.Remove(path) == nil {
+				removed = append(removed, path)
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// save writes the manifests that have changed.
+func (m *manifests) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := range m.dirty {
+		data, err := json.MarshalIndent(m.dirs[dir], "", "\t")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, manifestName)
+		if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+		delete(m.dirty, dir)
+	}
+	return nil
+}
+
+// hashFile returns the hex SHA-256 of the contents of filename.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func makeThumbnails(filenames []string) {
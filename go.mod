@@ -0,0 +1,3 @@
+module github.com/tao-yi/the-go-programming-language
+
+go 1.24